@@ -0,0 +1,65 @@
+package smtpd
+
+import (
+	"sync"
+	"time"
+)
+
+// Time after which failed authentications from an IP address are forgotten, ending any lockout.
+const authFailureExpiry = time.Hour
+
+// Interval between removals of expired entries from authFailures.
+const authFailureSweepInterval = time.Minute
+
+// authFailures counts failed authentications by client IP address, for AuthMaxFailures.
+// It is safe for concurrent use by multiple sessions.
+type authFailures struct {
+	mu      sync.Mutex
+	entries map[string]*authFailureEntry
+	swept   time.Time
+}
+
+type authFailureEntry struct {
+	count int       // Failures since the entry was created
+	last  time.Time // When the last failure happened
+}
+
+// Record a failed authentication from ip at now. Returns the number of recent failures from ip, including this one.
+func (a *authFailures) add(ip string, now time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Remove expired entries to bound the memory used.
+	if now.Sub(a.swept) >= authFailureSweepInterval {
+		for k, e := range a.entries {
+			if now.Sub(e.last) > authFailureExpiry {
+				delete(a.entries, k)
+			}
+		}
+		a.swept = now
+	}
+
+	if a.entries == nil {
+		a.entries = make(map[string]*authFailureEntry)
+	}
+	e, ok := a.entries[ip]
+	if !ok || now.Sub(e.last) > authFailureExpiry {
+		e = &authFailureEntry{}
+		a.entries[ip] = e
+	}
+	e.count++
+	e.last = now
+	return e.count
+}
+
+// Return the number of recent failed authentications from ip at now.
+func (a *authFailures) count(ip string, now time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e, ok := a.entries[ip]
+	if !ok || now.Sub(e.last) > authFailureExpiry {
+		return 0
+	}
+	return e.count
+}
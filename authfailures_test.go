@@ -0,0 +1,44 @@
+package smtpd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthFailures(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var a authFailures
+
+	if n := a.count("192.0.2.1", now); n != 0 {
+		t.Errorf("count() before any failure returned %d, want 0", n)
+	}
+	for want := 1; want <= 3; want++ {
+		if n := a.add("192.0.2.1", now); n != want {
+			t.Errorf("add() returned %d, want %d", n, want)
+		}
+		now = now.Add(10 * time.Minute)
+	}
+
+	// Failures are counted separately for each IP address.
+	if n := a.add("192.0.2.2", now); n != 1 {
+		t.Errorf("add() for another IP address returned %d, want 1", n)
+	}
+
+	// Failures are forgotten once none has happened for the expiry time.
+	if n := a.count("192.0.2.1", now.Add(authFailureExpiry-10*time.Minute)); n != 3 {
+		t.Errorf("count() before expiry returned %d, want 3", n)
+	}
+	now = now.Add(authFailureExpiry)
+	if n := a.count("192.0.2.1", now); n != 0 {
+		t.Errorf("count() after expiry returned %d, want 0", n)
+	}
+	if n := a.add("192.0.2.1", now); n != 1 {
+		t.Errorf("add() after expiry returned %d, want 1", n)
+	}
+
+	// Expired entries are removed.
+	a.add("192.0.2.3", now.Add(2*authFailureExpiry))
+	if len(a.entries) != 1 {
+		t.Errorf("authFailures has %d entries after expiry, want 1", len(a.entries))
+	}
+}
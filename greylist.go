@@ -0,0 +1,93 @@
+package smtpd
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Interval between removals of expired entries from a Greylist.
+const greylistSweepInterval = time.Minute
+
+// Greylist temporarily rejects recipients the first time they are seen from a
+// given client IP address and sender, and accepts them when the client retries
+// after a delay. Most spam software does not retry, while legitimate servers do.
+// It is safe for concurrent use by multiple sessions.
+type Greylist struct {
+	Delay  time.Duration // Minimum time before a retry is accepted
+	Expiry time.Duration // Time after which an unused entry is forgotten, defaults to 24 hours
+
+	mu      sync.Mutex
+	entries map[greylistKey]*greylistEntry
+	swept   time.Time
+	now     func() time.Time // Replaced in tests
+}
+
+type greylistKey struct {
+	ip, from, to string
+}
+
+type greylistEntry struct {
+	first time.Time // When the triplet was first seen
+	last  time.Time // When the triplet was last seen
+}
+
+// NewGreylist creates a Greylist which accepts retries after delay.
+func NewGreylist(delay time.Duration) *Greylist {
+	return &Greylist{Delay: delay}
+}
+
+// Check is a HandlerRcptWithError which greylists (IP address, sender, recipient) triplets.
+// Returns a temporary 450 error until the delay has elapsed since the triplet was first seen.
+func (g *Greylist) Check(remoteAddr net.Addr, from string, to string) error {
+	key := greylistKey{greylistIP(remoteAddr), from, to}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if g.now != nil {
+		now = g.now()
+	}
+	expiry := g.Expiry
+	if expiry == 0 {
+		expiry = 24 * time.Hour
+	}
+
+	// Remove expired entries to bound the memory used.
+	if now.Sub(g.swept) >= greylistSweepInterval {
+		for k, e := range g.entries {
+			if now.Sub(e.last) > expiry {
+				delete(g.entries, k)
+			}
+		}
+		g.swept = now
+	}
+
+	if g.entries == nil {
+		g.entries = make(map[greylistKey]*greylistEntry)
+	}
+	e, ok := g.entries[key]
+	if !ok || now.Sub(e.last) > expiry {
+		e = &greylistEntry{first: now}
+		g.entries[key] = e
+	}
+	e.last = now
+
+	if now.Sub(e.first) < g.Delay {
+		return &Error{Code: 450, EnhancedCode: "4.7.1", Message: "Greylisted, try again later"}
+	}
+	return nil
+}
+
+// Return the IP address of a remote address, or the whole address if it has no port.
+func greylistIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,63 @@
+package smtpd
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGreylistCheck(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	g := NewGreylist(5 * time.Minute)
+	g.now = func() time.Time { return now }
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	otherPort := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2525}
+
+	// The first attempt is temporarily rejected.
+	err := g.Check(addr, "sender@example.com", "recipient@example.com")
+	if e, ok := err.(*Error); !ok || e.Code != 450 || e.EnhancedCode != "4.7.1" {
+		t.Errorf("Check() on first attempt returned %v, want 450 4.7.1 error", err)
+	}
+
+	// A retry before the delay has elapsed is still rejected, regardless of the source port.
+	now = now.Add(time.Minute)
+	if err := g.Check(otherPort, "sender@example.com", "recipient@example.com"); err == nil {
+		t.Errorf("Check() before delay returned nil, want error")
+	}
+
+	// A different triplet is greylisted separately.
+	if err := g.Check(addr, "sender@example.com", "other@example.com"); err == nil {
+		t.Errorf("Check() for new recipient returned nil, want error")
+	}
+
+	// A retry after the delay has elapsed is accepted.
+	now = now.Add(5 * time.Minute)
+	if err := g.Check(addr, "sender@example.com", "recipient@example.com"); err != nil {
+		t.Errorf("Check() after delay returned %v, want nil", err)
+	}
+
+	// Unused entries expire, so the triplet is greylisted again.
+	now = now.Add(25 * time.Hour)
+	if err := g.Check(addr, "sender@example.com", "recipient@example.com"); err == nil {
+		t.Errorf("Check() after expiry returned nil, want error")
+	}
+	if len(g.entries) != 1 {
+		t.Errorf("Greylist has %d entries after expiry, want 1", len(g.entries))
+	}
+}
+
+func TestCmdRCPTWithGreylist(t *testing.T) {
+	g := NewGreylist(time.Hour)
+	conn := newConn(t, &Server{HandlerRcptWithError: g.Check})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "450")
+	cmdCode(t, conn, "DATA", "503")
+
+	// Skip the delay.
+	g.Delay = 0
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+}
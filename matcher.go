@@ -0,0 +1,41 @@
+package smtpd
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// RecipientMatcher reports whether mail for a recipient address is accepted, for Server.RecipientMatcher.
+type RecipientMatcher func(addr string) bool
+
+// GlobMatcher creates a RecipientMatcher which accepts addresses matching any of patterns, ignoring case.
+// Patterns containing "@" are matched against the whole address, e.g. "postmaster@*.example.com", and others against
+// the domain, e.g. "*.example.com", which matches subdomains of example.com but not example.com itself.
+// The pattern syntax is that of path.Match. Malformed patterns match nothing.
+func GlobMatcher(patterns ...string) RecipientMatcher {
+	lowered := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		lowered[i] = strings.ToLower(pattern)
+	}
+	return func(addr string) bool {
+		addr = strings.ToLower(addr)
+		domain := addressDomain(addr)
+		for _, pattern := range lowered {
+			name := domain
+			if strings.Contains(pattern, "@") {
+				name = addr
+			}
+			if matched, _ := path.Match(pattern, name); matched && name != "" {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RegexpMatcher creates a RecipientMatcher which accepts addresses matching re, e.g.
+// regexp.MustCompile(`(?i)@(example\.com|example\.net)$`).
+func RegexpMatcher(re *regexp.Regexp) RecipientMatcher {
+	return re.MatchString
+}
@@ -0,0 +1,65 @@
+package smtpd
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGlobMatcher(t *testing.T) {
+	match := GlobMatcher("*.example.com", "example.org", "postmaster@*.example.net", "[")
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"recipient@sub.example.com", true},
+		{"recipient@a.b.example.com", true},
+		{"recipient@SUB.Example.COM", true},
+		{"recipient@example.org", true},
+		{"Recipient@EXAMPLE.ORG", true},
+		{"postmaster@mail.example.net", true},
+		{"Postmaster@Mail.Example.Net", true},
+
+		// Negative cases.
+		{"recipient@example.com", false},
+		{"recipient@sub.example.com.evil.test", false},
+		{"recipient@sub.example.org", false},
+		{"recipient@mail.example.net", false},
+		{"postmaster@example.net", false},
+		{"example.org", false},
+		{"postmaster", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := match(tt.addr); got != tt.want {
+			t.Errorf("GlobMatcher(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if GlobMatcher()("recipient@example.com") {
+		t.Errorf("GlobMatcher() with no patterns accepted an address")
+	}
+}
+
+func TestRegexpMatcher(t *testing.T) {
+	match := RegexpMatcher(regexp.MustCompile(`(?i)^[a-z]+(\+[a-z0-9]+)?@(example\.com|example\.org)$`))
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"recipient@example.com", true},
+		{"recipient+tag1@example.org", true},
+		{"Recipient@EXAMPLE.COM", true},
+
+		// Negative cases.
+		{"recipient@example.net", false},
+		{"recipient@sub.example.com", false},
+		{"recipient@example.com.evil.test", false},
+		{"recipient1@example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := match(tt.addr); got != tt.want {
+			t.Errorf("RegexpMatcher(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
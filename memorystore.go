@@ -0,0 +1,78 @@
+package smtpd
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Default for MemoryStore.Size.
+const defaultMemoryStoreSize = 100
+
+// StoredMessage is a message kept by a MemoryStore.
+type StoredMessage struct {
+	From     string
+	To       []string
+	Data     []byte    // Message data, including the headers added by the server
+	Received time.Time // When the message was stored
+}
+
+// MemoryStore keeps the last messages received in memory, for development servers and tests. Set Server.Handler to
+// its Handle method to store every message received. It is safe for concurrent use by multiple sessions.
+type MemoryStore struct {
+	Size int // Maximum number of messages kept, the oldest being dropped first, defaults to 100
+
+	mu       sync.Mutex
+	messages []StoredMessage // Ring buffer, with the oldest message at next once it is full
+	next     int
+}
+
+// NewMemoryStore creates a MemoryStore which keeps the last size messages.
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{Size: size}
+}
+
+// Handle is a Handler which stores the message, dropping the oldest one if the store is full.
+func (m *MemoryStore) Handle(remoteAddr net.Addr, from string, to []string, data []byte) error {
+	// The session reuses its buffer for the next message, so keep copies.
+	msg := StoredMessage{
+		From:     from,
+		To:       append([]string(nil), to...),
+		Data:     append([]byte(nil), data...),
+		Received: time.Now(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	size := m.Size
+	if size <= 0 {
+		size = defaultMemoryStoreSize
+	}
+	if len(m.messages) < size {
+		m.messages = append(m.messages, msg)
+		return nil
+	}
+	m.messages[m.next] = msg
+	m.next = (m.next + 1) % len(m.messages)
+	return nil
+}
+
+// Messages returns the messages stored, oldest first.
+func (m *MemoryStore) Messages() []StoredMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := make([]StoredMessage, 0, len(m.messages))
+	msgs = append(msgs, m.messages[m.next:]...)
+	return append(msgs, m.messages[:m.next]...)
+}
+
+// Clear removes all the messages stored.
+func (m *MemoryStore) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = nil
+	m.next = 0
+}
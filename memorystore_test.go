@@ -0,0 +1,69 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	m := NewMemoryStore(2)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	for i := 1; i <= 3; i++ {
+		data := []byte(fmt.Sprintf("Message %d", i))
+		if err := m.Handle(addr, "sender@example.com", []string{"recipient@example.com"}, data); err != nil {
+			t.Fatalf("Handle() returned %v", err)
+		}
+		data[0] = 'X' // The data is copied, as the session reuses its buffer.
+	}
+
+	// Only the last messages are kept, oldest first.
+	msgs := m.Messages()
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, string(msg.Data))
+	}
+	if want := []string{"Message 2", "Message 3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Messages() returned %q, want %q", got, want)
+	}
+	if msgs[0].Received.IsZero() {
+		t.Errorf("Stored message has no received time")
+	}
+
+	m.Clear()
+	if msgs := m.Messages(); len(msgs) != 0 {
+		t.Errorf("Messages() after Clear() returned %d messages, want 0", len(msgs))
+	}
+}
+
+func TestCmdDATAWithMemoryStore(t *testing.T) {
+	store := NewMemoryStore(0)
+	conn := newConn(t, &Server{Handler: store.Handle})
+	cmdCode(t, conn, "EHLO host.example.com", "250")
+	for i := 1; i <= 3; i++ {
+		cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+		cmdCode(t, conn, fmt.Sprintf("RCPT TO:<recipient%d@example.com>", i), "250")
+		cmdCode(t, conn, "DATA", "354")
+		cmdCode(t, conn, fmt.Sprintf("Test message %d.\r\n.", i), "250")
+	}
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+
+	msgs := store.Messages()
+	if len(msgs) != 3 {
+		t.Fatalf("Store has %d messages, want 3", len(msgs))
+	}
+	for i, msg := range msgs {
+		if msg.From != "sender@example.com" {
+			t.Errorf("Message %d is from %q, want %q", i+1, msg.From, "sender@example.com")
+		}
+		if want := []string{fmt.Sprintf("recipient%d@example.com", i+1)}; !reflect.DeepEqual(msg.To, want) {
+			t.Errorf("Message %d is to %v, want %v", i+1, msg.To, want)
+		}
+		if want := fmt.Sprintf("Test message %d.\r\n", i+1); !bytes.HasSuffix(msg.Data, []byte(want)) {
+			t.Errorf("Message %d data is %q, want it to end with %q", i+1, msg.Data, want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Signature at the start of a PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Maximum length of a PROXY protocol version 1 header, including the CRLF.
+const proxyV1MaxLength = 107
+
+var errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyConn is a connection received through a proxy, with the addresses of the original connection.
+type proxyConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// Read a PROXY protocol header (version 1 or 2) as sent by HAProxy, an AWS NLB and others before the SMTP session.
+// Returns the source and destination addresses of the original connection, or nil addresses if the proxy did not
+// supply them, e.g. for its own health checks.
+func readProxyHeader(br *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2Header(br)
+	}
+	return readProxyV1Header(br)
+}
+
+// Read a version 1 header, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n".
+func readProxyV1Header(br *bufio.Reader) (src, dst net.Addr, err error) {
+	line, err := readLimitedLine(br, proxyV1MaxLength)
+	if err == errLineTooLong {
+		return nil, nil, errInvalidProxyHeader
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errInvalidProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, errInvalidProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, errInvalidProxyHeader
+	}
+	if len(fields) != 6 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, nil, errInvalidProxyHeader
+	}
+	if ipv4 := fields[1] == "TCP4"; (srcIP.To4() != nil) != ipv4 || (dstIP.To4() != nil) != ipv4 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// Read a version 2 header: the signature, version and command, address family and protocol, the length of the rest,
+// then the addresses and ports followed by any TLV (type, length, value) extensions, which are checked and skipped.
+func readProxyV2Header(br *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL, e.g. a health check from the proxy itself
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	case 0x00, 0x31: // Unspecified, or a Unix socket, with no address usable for the session
+		return nil, nil, nil
+	default:
+		return nil, nil, errInvalidProxyHeader
+	}
+	addrLen := 2*ipLen + 4
+	if len(payload) < addrLen {
+		return nil, nil, errInvalidProxyHeader
+	}
+	for tlvs := payload[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 || len(tlvs) < 3+int(binary.BigEndian.Uint16(tlvs[1:])) {
+			return nil, nil, errInvalidProxyHeader
+		}
+		tlvs = tlvs[3+int(binary.BigEndian.Uint16(tlvs[1:])):]
+	}
+
+	src = &net.TCPAddr{IP: net.IP(payload[:ipLen]), Port: int(binary.BigEndian.Uint16(payload[2*ipLen:]))}
+	dst = &net.TCPAddr{IP: net.IP(payload[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))}
+	return src, dst, nil
+}
@@ -0,0 +1,183 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		header []byte
+		src    string
+		dst    string
+	}{
+		// Version 2, TCP over IPv4, from 192.0.2.1:56324 to 198.51.100.1:25.
+		{[]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" +
+			"\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x19"), "192.0.2.1:56324", "198.51.100.1:25"},
+		// Version 2, TCP over IPv6, from [2001:db8::1]:56324 to [2001:db8::2]:25, with an AWS VPC endpoint TLV.
+		{[]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x2f" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+			"\xdc\x04\x00\x19" +
+			"\xea\x00\x08\x01vpce-12"), "[2001:db8::1]:56324", "[2001:db8::2]:25"},
+		// Version 2 LOCAL command, e.g. a health check.
+		{[]byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"), "", ""},
+		// Version 1.
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n"), "192.0.2.1:56324", "198.51.100.1:25"},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\n"), "[2001:db8::1]:56324", "[2001:db8::2]:25"},
+		{[]byte("PROXY UNKNOWN\r\n"), "", ""},
+	}
+
+	for _, tt := range tests {
+		// The SMTP session follows the header, and must not be consumed.
+		br := bufio.NewReader(bytes.NewReader(append(tt.header, "EHLO host.example.com\r\n"...)))
+		src, dst, err := readProxyHeader(br)
+		if err != nil {
+			t.Errorf("readProxyHeader(%q) returned error %v", tt.header, err)
+			continue
+		}
+		if tt.src == "" {
+			if src != nil || dst != nil {
+				t.Errorf("readProxyHeader(%q) returned %v, %v, want no addresses", tt.header, src, dst)
+			}
+		} else if src == nil || dst == nil || src.String() != tt.src || dst.String() != tt.dst {
+			t.Errorf("readProxyHeader(%q) returned %v, %v, want %s, %s", tt.header, src, dst, tt.src, tt.dst)
+		}
+		if line, _ := br.ReadString('\n'); line != "EHLO host.example.com\r\n" {
+			t.Errorf("Line after PROXY header %q is %q, want EHLO", tt.header, line)
+		}
+	}
+
+	malformed := [][]byte{
+		[]byte("EHLO host.example.com\r\n"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"),
+		[]byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 25\r\n"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 65536\r\n"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\n"),
+		[]byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 25\r\n"),
+		[]byte("PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n"),
+		// Wrong version.
+		[]byte("\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x0c\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x19"),
+		// Addresses shorter than the family requires.
+		[]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x0c\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x19"),
+		// UDP.
+		[]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x12\x00\x0c\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x19"),
+		// A TLV longer than the header.
+		[]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x10\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x19\xea\x00\x08\x01"),
+	}
+	for _, header := range malformed {
+		br := bufio.NewReader(bytes.NewReader(header))
+		if _, _, err := readProxyHeader(br); err == nil {
+			t.Errorf("readProxyHeader(%q) returned no error, want an error", header)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addrs := make(chan net.Addr, 1)
+	heloChecker := func(remoteAddr net.Addr, name string, args string) error {
+		addrs <- remoteAddr
+		return nil
+	}
+	srv := &Server{HeloChecker: heloChecker, ProxyProtocolAllowed: []string{"127.0.0.1"}, DisableReverseDNS: true}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// A trusted proxy supplies the address of the client.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to test server: %v", err)
+	}
+	fmt.Fprintf(conn, "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x19")
+	reader := bufio.NewReader(conn)
+	if banner, err := reader.ReadString('\n'); err != nil || banner[0:3] != "220" {
+		t.Fatalf("Banner after PROXY header is %q, err %v, want 220", banner, err)
+	}
+	fmt.Fprintf(conn, "HELO host.example.com\r\n")
+	if resp, err := reader.ReadString('\n'); err != nil || resp[0:3] != "250" {
+		t.Errorf("HELO response is %q, err %v, want 250", resp, err)
+	}
+	if addr := <-addrs; addr.String() != "192.0.2.1:56324" {
+		t.Errorf("Remote address is %v, want 192.0.2.1:56324", addr)
+	}
+	conn.Close()
+
+	// The connection is closed without a banner if the header is malformed.
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to test server: %v", err)
+	}
+	fmt.Fprintf(conn, "PROXY TCP4 192.0.2.1\r\n")
+	if resp, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+		t.Errorf("Response to malformed PROXY header is %q, want connection closed", resp)
+	}
+	conn.Close()
+
+	// A header from a peer which is not a trusted proxy is not honoured.
+	conn = newConn(t, &Server{HeloChecker: heloChecker})
+	reader = bufio.NewReader(conn)
+	fmt.Fprintf(conn, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nHELO host.example.com\r\n")
+	for _, code := range []string{"500", "250"} {
+		if resp, err := reader.ReadString('\n'); err != nil || resp[0:3] != code {
+			t.Errorf("Response is %q, err %v, want %s", resp, err, code)
+		}
+	}
+	if addr := <-addrs; strings.HasPrefix(addr.String(), "192.0.2.1:") {
+		t.Errorf("Remote address is %v, want the address of the connection", addr)
+	}
+	conn.Close()
+}
+
+func TestProxyProtocolXClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	received := make(chan string, 1)
+	handler := func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+		received <- strings.SplitN(string(data), "\r\n", 2)[0]
+		return nil
+	}
+	srv := &Server{Handler: handler, ProxyProtocolAllowed: []string{"127.0.0.1"}, DisableReverseDNS: true}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// XCLIENT is trusted by the address of the client supplied in the PROXY header, not that of the proxy.
+	tests := []struct {
+		allowed string
+		want    string
+	}{
+		{"192.0.2.1", "Received: from host.example.com (client.example.com [198.51.100.7])"},
+		{"127.0.0.1", "Received: from host.example.com (unknown [192.0.2.1])"},
+	}
+	for _, tt := range tests {
+		srv.XClientAllowed = []string{tt.allowed}
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect to test server: %v", err)
+		}
+		fmt.Fprintf(conn, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n")
+		if banner, err := bufio.NewReader(conn).ReadString('\n'); err != nil || banner[0:3] != "220" {
+			t.Fatalf("Banner after PROXY header is %q, err %v, want 220", banner, err)
+		}
+		cmdCode(t, conn, "XCLIENT ADDR=198.51.100.7 NAME=client.example.com", "250")
+		cmdCode(t, conn, "HELO host.example.com", "250")
+		cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+		cmdCode(t, conn, "RCPT TO:<recipient@example.com>", "250")
+		cmdCode(t, conn, "DATA", "354")
+		cmdCode(t, conn, "Test message.\r\n.", "250")
+		cmdCode(t, conn, "QUIT", "221")
+		conn.Close()
+		if header := <-received; header != tt.want {
+			t.Errorf("With XClientAllowed %q, Received header is %q, want %q", tt.allowed, header, tt.want)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build (linux && !amd64 && !386 && !arm) || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux,!amd64,!386,!arm darwin dragonfly freebsd netbsd openbsd
+
+package smtpd
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
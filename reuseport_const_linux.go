@@ -0,0 +1,7 @@
+//go:build amd64 || 386 || arm
+// +build amd64 386 arm
+
+package smtpd
+
+// Package syscall lacks SO_REUSEPORT on these architectures, though Linux has supported it since 3.9.
+const soReusePort = 0xf
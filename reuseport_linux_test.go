@@ -0,0 +1,56 @@
+package smtpd
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReusePort(t *testing.T) {
+	// Start a server on a port assigned by the operating system.
+	old := &Server{Addr: "127.0.0.1:0", ReusePort: true}
+	go old.ListenAndServe()
+	defer old.Close()
+	select {
+	case <-old.Listening():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server did not start listening")
+	}
+	addr := old.ListenerAddr().String()
+
+	// Without ReusePort, a second server cannot listen on the same port.
+	if err := (&Server{Addr: addr}).ListenAndServe(); err == nil || !strings.Contains(err.Error(), "address already in use") {
+		t.Errorf("ListenAndServe() without ReusePort returned %v, want address already in use", err)
+	}
+
+	// With ReusePort, it can, and serves connections once the old server has closed.
+	srv := &Server{Addr: addr, ReusePort: true, Hostname: "new.example.com"}
+	go srv.ListenAndServe()
+	defer srv.Close()
+	select {
+	case <-srv.Listening():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server with ReusePort did not start listening on %s", addr)
+	}
+	old.Close()
+
+	// The old server closes its listener asynchronously, so connections may reach it briefly.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to connect to %s: %v", addr, err)
+		}
+		banner, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err == nil && strings.HasPrefix(banner, "220 new.example.com ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Banner is %q, err %v, want one from the new server", banner, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package smtpd
+
+import (
+	"errors"
+	"syscall"
+)
+
+// SO_REUSEPORT is not available, so ReusePort makes listening fail rather than silently sharing nothing.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("smtpd: ReusePort is not supported on this platform")
+}
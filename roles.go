@@ -0,0 +1,50 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Idle timeout set by the constructors below, as RFC 5321 section 4.5.3.2 recommends.
+const roleTimeout = 5 * time.Minute
+
+// NewMXServer creates a Server which receives mail for local domains from other servers on port 25, passing each
+// message to handler. Clients must send HELO or EHLO before MAIL. Fields such as LocalDomains and TLSConfig can be
+// set on the result before it is started.
+func NewMXServer(addr string, handler Handler) *Server {
+	return &Server{
+		Addr:        addr,
+		Handler:     handler,
+		RequireHelo: true,
+		Timeout:     roleTimeout,
+	}
+}
+
+// NewSubmissionServer creates a Server which accepts mail from authenticated users (RFC 6409), on port 587 unless
+// addr is set. Clients must use STARTTLS before any other command, then authenticate with auth before MAIL. Only the
+// PLAIN and LOGIN mechanisms are offered, so AUTH is not listed until TLS is in use.
+func NewSubmissionServer(addr string, tlsConfig *tls.Config, auth AuthHandler) *Server {
+	return &Server{
+		Addr:         addr,
+		AuthHandler:  auth,
+		AuthMechs:    map[string]bool{"CRAM-MD5": false},
+		AuthRequired: true,
+		RequireHelo:  true,
+		Submission:   true,
+		TLSConfig:    tlsConfig,
+		TLSRequired:  true,
+		Timeout:      roleTimeout,
+	}
+}
+
+// NewLMTPServer creates a Server which speaks LMTP (RFC 2033) on the network address addr, e.g. a Unix socket for a
+// front-end MTA to deliver mail to, passing each message to handler to report the result for each recipient.
+func NewLMTPServer(network, addr string, handler HandlerLMTP) *Server {
+	return &Server{
+		Addr:        addr,
+		HandlerLMTP: handler,
+		LMTP:        true,
+		Network:     network,
+		Timeout:     roleTimeout,
+	}
+}
@@ -0,0 +1,98 @@
+package smtpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Send EHLO or LHLO and return the extensions listed in the reply.
+func helloExtensions(t *testing.T, conn net.Conn, verb string) map[string]string {
+	t.Helper()
+	fmt.Fprintf(conn, "%s host.example.com\r\n", verb)
+	reader := bufio.NewReader(conn)
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read %s response: %v", verb, err)
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+		if len(line) < 4 || line[3] != '-' {
+			break
+		}
+	}
+	return parseExtensions(t, strings.Join(lines, "\n"))
+}
+
+func TestNewMXServer(t *testing.T) {
+	srv := NewMXServer(":2525", func(a net.Addr, f string, t []string, d []byte) error { return nil })
+	if srv.Addr != ":2525" || srv.Timeout == 0 {
+		t.Errorf("NewMXServer() set Addr %q and Timeout %v", srv.Addr, srv.Timeout)
+	}
+	conn := newConn(t, srv)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "503")
+	extensions := helloExtensions(t, conn, "EHLO")
+	for _, ext := range []string{"SIZE", "DSN", "ENHANCEDSTATUSCODES"} {
+		if _, ok := extensions[ext]; !ok {
+			t.Errorf("%s is not listed by an MX server", ext)
+		}
+	}
+	if _, ok := extensions["AUTH"]; ok {
+		t.Errorf("AUTH is listed by an MX server")
+	}
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+}
+
+func TestNewSubmissionServer(t *testing.T) {
+	srv := NewSubmissionServer("", &tls.Config{Certificates: []tls.Certificate{cert}}, authHandler)
+	conn := newConn(t, srv)
+
+	// AUTH is only listed, and MAIL only allowed, once TLS is in use.
+	extensions := helloExtensions(t, conn, "EHLO")
+	if _, ok := extensions["STARTTLS"]; !ok {
+		t.Errorf("STARTTLS is not listed by a submission server")
+	}
+	if _, ok := extensions["AUTH"]; ok {
+		t.Errorf("AUTH is listed by a submission server before STARTTLS")
+	}
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", "530")
+	cmdCode(t, conn, "STARTTLS", "220")
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("Failed to perform TLS handshake: %v", err)
+	}
+
+	// Authentication is required before MAIL.
+	extensions = helloExtensions(t, tlsConn, "EHLO")
+	if mechs := strings.Fields(extensions["AUTH"]); len(mechs) != 2 || !strings.Contains(extensions["AUTH"], "PLAIN") || !strings.Contains(extensions["AUTH"], "LOGIN") {
+		t.Errorf("Submission server lists AUTH %q, want PLAIN and LOGIN", extensions["AUTH"])
+	}
+	cmdCode(t, tlsConn, "MAIL FROM:<sender@example.com>", "530")
+	cmdCode(t, tlsConn, "AUTH PLAIN AHZhbGlkAHBhc3N3b3Jk", "235")
+	cmdCode(t, tlsConn, "MAIL FROM:<sender@example.com>", "250")
+	cmdCode(t, tlsConn, "QUIT", "221")
+	tlsConn.Close()
+}
+
+func TestNewLMTPServer(t *testing.T) {
+	srv := NewLMTPServer("unix", "/run/smtpd/lmtp.sock", func(md Metadata, env *Envelope) []*SMTPError {
+		return nil
+	})
+	if srv.Network != "unix" || srv.Addr != "/run/smtpd/lmtp.sock" {
+		t.Errorf("NewLMTPServer() set Network %q and Addr %q", srv.Network, srv.Addr)
+	}
+	conn := newConn(t, srv)
+	cmdCode(t, conn, "EHLO host.example.com", "500")
+	extensions := helloExtensions(t, conn, "LHLO")
+	if _, ok := extensions["ENHANCEDSTATUSCODES"]; !ok {
+		t.Errorf("ENHANCEDSTATUSCODES is not listed by an LMTP server")
+	}
+	cmdCode(t, conn, "QUIT", "221")
+	conn.Close()
+}
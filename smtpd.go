@@ -5,17 +5,24 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/mail"
+	"net/textproto"
 	"os"
+	"reflect"
 	"regexp"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,23 +32,202 @@ import (
 
 var (
 	// Debug `true` enables verbose logging.
-	Debug      = false
-	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:\s?<(.+)>`)
-	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:\s?<(.*)>(\s(.*))?`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
-	mailSizeRE = regexp.MustCompile(`[Ss][Ii][Zz][Ee]=(\d+)`)
+	Debug = false
 )
 
 // Handler function called upon successful receipt of an email.
 // Results in a "250 2.0.0 Ok: queued" response.
+// The handler is called before the response is sent, so a returned *Error (e.g. a temporary 451 when relaying
+// to an unavailable upstream server) is sent to the client instead.
+// Handlers are called synchronously, so the messages on a connection are handled in order. The client waits for the
+// handler to return, so it should finish well within the client's timeout (10 minutes in RFC 5321 section 4.5.3.2.6).
 type Handler func(remoteAddr net.Addr, from string, to []string, data []byte) error
 
 // MsgIDHandler function called upon successful receipt of an email. Returns a message ID.
 // Results in a "250 2.0.0 Ok: queued as <message-id>" response.
 type MsgIDHandler func(remoteAddr net.Addr, from string, to []string, data []byte) (string, error)
 
+// MetadataHandler function called upon successful receipt of an email, with details of the session.
+// Results in a "250 2.0.0 Ok: queued" response.
+type MetadataHandler func(md Metadata, from string, to []string, data []byte) error
+
+// ParsedHandler function called upon successful receipt of an email, with the message parsed by net/mail,
+// including the headers added by the server. Results in a "250 2.0.0 Ok: queued" response.
+type ParsedHandler func(md Metadata, from string, to []string, msg *mail.Message) error
+
+// HandlerEnvelope function called upon successful receipt of an email, with the envelope and data in a single value.
+// Results in a "250 2.0.0 Ok: queued" response.
+type HandlerEnvelope func(md Metadata, env *Envelope) error
+
+// HandlerFunc function registered with Server.Use, called upon successful receipt of an email before the handler, e.g.
+// for logging or spam scoring. It calls next at most once to continue with the following HandlerFunc and finally the
+// handler, returning the result. Returning an error without calling next rejects the email, and the error is sent to
+// the client as for a Handler. It is not called for a ReaderHandler, a SpillHandler or a HandlerLMTP.
+type HandlerFunc func(md Metadata, env *Envelope, next func() error) error
+
+// HandlerLMTP function called upon successful receipt of an email in LMTP mode, to deliver it to each recipient.
+// Returns the result for each recipient, in the order of env.To: nil for success, or the error sent to the client.
+// Missing results are successes, so returning nil accepts the message for every recipient.
+type HandlerLMTP func(md Metadata, env *Envelope) []*SMTPError
+
+// ReaderHandler function called upon receipt of the DATA command, to read the email as it is received.
+// The reader yields the Received header followed by the message data, with dot stuffing removed.
+// It returns an error if the maximum message size is exceeded or a read times out.
+// Results in a "250 2.0.0 Ok: queued" response once the handler returns.
+type ReaderHandler func(md Metadata, from string, to []string, r io.Reader) error
+
+// SpillHandler function called upon successful receipt of an email, with the Received header and message data.
+// Messages larger than SpillToDiskThreshold are read from a temporary file, which is removed when the handler returns,
+// so the body must not be used after that. Smaller messages are read from memory.
+// Results in a "250 2.0.0 Ok: queued" response.
+type SpillHandler func(md Metadata, from string, to []string, body io.ReadSeeker) error
+
+// AfterDataHandler function called in a new goroutine after the reply to a received email has been sent, for
+// post-processing such as logging or archival which should not delay the client. The error is the one returned by
+// the handler which decided the reply, or nil if the email was accepted. It may run concurrently with the handling of
+// later emails on the same connection, so the order of calls is not guaranteed. It is not called for a ReaderHandler or
+// SpillHandler.
+type AfterDataHandler func(md Metadata, from string, to []string, data []byte, err error)
+
+// HeaderBuilder function called to create the headers prepended to a received email, in place of the
+// default Received header. Returning an empty slice omits the headers entirely.
+// Headers must be terminated with CRLF.
+type HeaderBuilder func(md Metadata, to []string) []byte
+
+// DKIMSigner signs messages from authenticated clients, e.g. by wrapping a DKIM library.
+// Sign returns the DKIM-Signature header field for the message, terminated with CRLF, which is prepended to it.
+type DKIMSigner interface {
+	Sign(data []byte) ([]byte, error)
+}
+
+// Metrics receives counters from the server, so they can be exported with any metrics library, e.g. Prometheus or
+// statsd. Methods are called concurrently by different sessions.
+type Metrics interface {
+	IncConnections()    // A connection has been accepted
+	IncMessages()       // A message has been accepted
+	AddBytesIn(n int64) // Bytes read from a client during a session which has ended, as for SessionSummary.BytesIn
+	IncAuthFailures()   // Invalid credentials have been supplied with AUTH
+	IncTLSUpgrades()    // A connection has been upgraded to TLS with STARTTLS
+}
+
+// HeaderChecker function called with the header of a received email, as soon as the header has been read and before
+// the body is. Returning an error rejects the email without handling it: the rest of the data is read and discarded,
+// then the error is sent to the client as for a Handler. It is not called for a ReaderHandler or SpillHandler.
+type HeaderChecker func(md Metadata, header textproto.MIMEHeader) error
+
+// ReceivedHeaderMode sets how much is recorded about the client in the Received header added to received emails.
+type ReceivedHeaderMode int
+
+const (
+	ReceivedFull    ReceivedHeaderMode = iota // Client host name, reverse DNS name and IP address
+	ReceivedMinimal                           // Client host name only, as with HideClientIP
+	ReceivedNone                              // No Received header is added
+)
+
+// FlushStrategy sets when replies are sent to the client.
+type FlushStrategy int
+
+const (
+	FlushImmediate FlushStrategy = iota // Send each reply as soon as it is written
+	FlushCoalesced                      // Hold successful replies to pipelined commands, and send them together with the next reply sent before waiting for the client
+)
+
+// HeloChecker function called on HELO or EHLO, with the domain or address literal identifying the client
+// and the full argument sent. Returns nil to accept the greeting, or an error to reject it.
+// A returned *Error is sent to the client.
+type HeloChecker func(remoteAddr net.Addr, name string, args string) error
+
+// SizeAdvertiser function called on EHLO to compute the maximum message size listed with SIZE, e.g. a larger size
+// once the client has authenticated. The size is only advertised: the limit enforced is MaxSize, or Limits.MaxSize if
+// a handler has set it with SetLimits, which should agree with the size returned.
+type SizeAdvertiser func(md Metadata) int
+
+// SenderChecker function called on MAIL, after the command has been parsed. Returns nil to accept the sender,
+// or an error to reject it. A returned *Error (e.g. "550 5.7.1 Sender rejected") is sent to the client.
+type SenderChecker func(remoteAddr net.Addr, from string) error
+
+// RcptRewriter function called on RCPT, after the command has been parsed, to canonicalize the recipient address,
+// e.g. by lower casing it and removing a "+tag". The returned address is checked, stored and passed to handlers in
+// place of the one sent, which is still recorded in the Received header. Returns an error to reject the recipient.
+// A returned *Error is sent to the client.
+type RcptRewriter func(addr string) (string, error)
+
+// DataChecker function called on DATA, before the 354 reply, e.g. to enforce a sending quota before the message is
+// read. The context is the session context, as in Metadata. Returns nil to accept the message data, or an error to
+// reject it without reading the data. A returned *Error (e.g. "452 4.2.2 Quota exceeded") is sent to the client.
+type DataChecker func(ctx context.Context, from string, to []string) error
+
+// HandlerEtrn function called on ETRN (RFC 1985), with the node whose queued mail should be delivered, usually a
+// domain name. Mail is expected to be delivered in the background, so the handler should return once it has started.
+// Results in a "250 2.0.0 Queuing for node <node> started" response.
+// A returned *Error is sent as is, e.g. a 459 if the node is not allowed, anything else results in a 458 response.
+type HandlerEtrn func(md Metadata, node string) error
+
+// HandlerAtrn function called on ATRN (RFC 2645) from an authenticated client, with the domains requested by the client,
+// or none to request every domain the client is authorised for. The connection has been reversed, so the handler
+// takes over the connection as the SMTP client to deliver queued mail, starting by reading the 220 greeting.
+// The session ends, and the connection is closed, once it returns.
+type HandlerAtrn func(md Metadata, domains []string, conn net.Conn) error
+
+// HelpHandler function called on HELP, with the topic requested (if any). Returns the help text, which may contain
+// several lines, or an error (e.g. a 504 *Error for an unknown topic).
+type HelpHandler func(topic string) (string, error)
+
 // HandlerRcpt function called on RCPT. Return accept status.
 type HandlerRcpt func(remoteAddr net.Addr, from string, to string) bool
 
+// MessageModifier function called upon receipt of an email, before it is passed to the handler. The data includes the
+// Received header, and the returned data replaces it. Returns an error to reject the email, resulting in a
+// "451 4.3.5" response, or the returned *Error.
+type MessageModifier func(md Metadata, data []byte) ([]byte, error)
+
+// HandlerRcptWithMetadata function called on RCPT, with details of the session. Returns nil to accept the recipient,
+// or an error to reject it. A returned *Error is sent to the client.
+type HandlerRcptWithMetadata func(md Metadata, from string, to string) error
+
+// HandlerRcptWithError function called on RCPT. Returns nil to accept the recipient, or an error to reject it.
+// A returned *Error (e.g. a temporary 450 when greylisting) is sent to the client.
+type HandlerRcptWithError func(remoteAddr net.Addr, from string, to string) error
+
+// HandlerRcptWithParams function called on RCPT, with the parameters sent after the address keyed by upper case name,
+// e.g. "NOTIFY" and "ORCPT" (RFC 3461). Values are as sent, so ORCPT is still xtext encoded. Return accept status.
+type HandlerRcptWithParams func(remoteAddr net.Addr, from string, to string, params map[string]string) bool
+
+// HandlerRcptBatch function called on DATA, to check all the recipients accepted with RCPT at once, e.g. with a
+// single database query. Returns an error for each rejected recipient, keyed by address; recipients not in the map
+// are accepted. In LMTP mode the message is delivered to the accepted recipients only, and each rejected recipient
+// has its error sent in its reply after the message data. In SMTP mode DATA has a single reply, so DATA is rejected
+// with the first error unless every recipient is accepted.
+type HandlerRcptBatch func(md Metadata, from string, to []string) map[string]error
+
+// ConnectHandler function called when a client connects, before the banner is sent. Returning an error refuses the
+// client in place of the banner, then closes the connection (RFC 5321 section 3.1): with 421 for a temporary *Error or
+// any other error, so the client retries later, or with 554 for a permanent *Error. The enhanced status code and
+// message of an *Error are sent if set.
+type ConnectHandler func(md Metadata) error
+
+// SessionEndHandler function called when a session ends, after the connection has been closed.
+type SessionEndHandler func(md Metadata, summary SessionSummary)
+
+// SessionSummary describes a session which has ended.
+type SessionSummary struct {
+	BytesIn  int64 // Bytes read from the client after any TLS decryption, including message data
+	BytesOut int64 // Bytes written to the client before any TLS encryption
+	Duration time.Duration
+	Reason   EndReason // Why the session ended
+}
+
+// EndReason describes why a session ended.
+type EndReason int
+
+const (
+	ReasonQuit             EndReason = iota // The client sent QUIT, or the connection was handed over with ATRN
+	ReasonTimeout                           // The client did not send or receive data within Timeout
+	ReasonClientDisconnect                  // The client closed the connection without QUIT
+	ReasonError                             // The server closed the connection, e.g. after a 421 reply or refusing the client
+	ReasonShutdown                          // The server was closed or shut down
+)
+
 // AuthHandler function called when a login attempt is performed. Returns true if credentials are correct.
 type AuthHandler func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error)
 
@@ -81,34 +267,447 @@ func (err maxSizeExceededError) Error() string {
 	return fmt.Sprintf("552 5.3.4 Requested mail action aborted: exceeded storage allocation (%d)", err.limit)
 }
 
+type maxLinesExceededError struct {
+	limit int
+}
+
+func maxLinesExceeded(limit int) maxLinesExceededError {
+	return maxLinesExceededError{limit}
+}
+
+// RFC 3463 defines enhanced status code x.3.4 as "Message too big for system".
+func (err maxLinesExceededError) Error() string {
+	return fmt.Sprintf("552 5.3.4 Requested mail action aborted: exceeded maximum number of lines (%d)", err.limit)
+}
+
+type lineTooLongError struct {
+	limit int
+}
+
+func lineTooLong(limit int) lineTooLongError {
+	return lineTooLongError{limit}
+}
+
+// RFC 5321 section 4.5.3.1.10 specifies the response message for a text line which is too long.
+func (err lineTooLongError) Error() string {
+	return fmt.Sprintf("500 5.5.2 Line too long (%d)", err.limit)
+}
+
+type eightBitDataError struct{}
+
+// RFC 3463 defines enhanced status code x.6.1 as "Media not supported".
+func (err eightBitDataError) Error() string {
+	return "554 5.6.1 8-bit data not permitted"
+}
+
+type bareLineEndingError struct{}
+
+// RFC 3463 defines enhanced status code x.6.0 as "Other or undefined media error".
+func (err bareLineEndingError) Error() string {
+	return "554 5.6.0 Bare CR or LF not permitted"
+}
+
+// Error is an SMTP reply returned by a handler in place of the default response.
+// A 4xx code indicates a temporary failure, so the client should queue the message and retry later.
+// A 5xx code indicates a permanent failure. A 421 code also closes the connection.
+type Error struct {
+	Code         int    // Reply code, e.g. 451
+	EnhancedCode string // Enhanced status code (RFC 3463), e.g. "4.4.1", sent on every line. Leave empty to send Message as is, e.g. to relay the reply of an upstream server from a *textproto.Error.
+	Message      string // Lines separated by "\n" are sent as a multiline reply
+}
+
+// Error formats the reply as sent to the client.
+func (err *Error) Error() string {
+	if err.EnhancedCode == "" {
+		return fmt.Sprintf("%d %s", err.Code, err.Message)
+	}
+	return fmt.Sprintf("%d %s %s", err.Code, err.EnhancedCode, err.Message)
+}
+
+// Temporary reports whether the reply is a transient (4xx) failure.
+func (err *Error) Temporary() bool {
+	return err.Code >= 400 && err.Code < 500
+}
+
+// SMTPError is an alias of Error, for handlers which prefer the longer name.
+type SMTPError = Error
+
+// NewSMTPError returns an Error with the reply code, enhanced status code and message, e.g.
+// NewSMTPError(550, "5.7.1", "Sender rejected").
+func NewSMTPError(code int, enhancedCode, message string) *SMTPError {
+	return &SMTPError{Code: code, EnhancedCode: enhancedCode, Message: message}
+}
+
+// Metadata describes the session and mail transaction a handler is called for.
+type Metadata struct {
+	RemoteAddr net.Addr        // Remote end of the TCP connection
+	LocalAddr  net.Addr        // Local end of the TCP connection, e.g. to apply different policies to ports 25 and 587
+	RemoteName string          // Hostname supplied with HELO or EHLO
+	AuthSender string          // Mailbox supplied with the MAIL AUTH parameter by an authenticated client, empty for "<>"
+	DSN        DSN             // Delivery status notification parameters
+	Limits     Limits          // Overrides of the server limits when the handler was called, which SetLimits changes
+	Context    context.Context // Cancelled when the session ends. Derived from the context returned by BaseContext, if set.
+
+	setLimits func(Limits)
+}
+
+// SetLimits overrides the server limits for the rest of the session, e.g. to give authenticated users different limits.
+// It is safe to call from any handler, including AfterData, which runs concurrently with the session.
+func (md Metadata) SetLimits(limits Limits) {
+	if md.setLimits != nil {
+		md.setLimits(limits)
+	}
+}
+
+// Envelope describes a received email, with the parameters sent with the MAIL command.
+type Envelope struct {
+	From   string            // Sender address sent with MAIL
+	To     []string          // Recipient addresses sent with RCPT
+	Params map[string]string // Parameters sent with MAIL, keyed by upper case name, e.g. "SIZE", "BODY", "RET" and "ENVID"
+	Size   int               // Message size declared with the SIZE parameter, or 0 if none was sent
+	Data   []byte            // Message data, including the headers added by the server
+}
+
+// Limits overrides the server limits for a session, e.g. to give authenticated users different limits.
+// Zero values use the server limits.
+type Limits struct {
+	MaxSize       int // Maximum message size allowed, in bytes, as for Server.MaxSize
+	MaxRecipients int // Maximum number of recipients
+}
+
+// DSN holds the delivery status notification parameters of a mail transaction (RFC 3461).
+type DSN struct {
+	Ret        string         // RET parameter of MAIL: "FULL", "HDRS" or empty if not sent
+	EnvID      string         // ENVID parameter of MAIL, decoded from xtext
+	Recipients []DSNRecipient // Parameters of each accepted RCPT, in the same order as the recipients
+}
+
+// DSNRecipient holds the delivery status notification parameters of a RCPT command.
+type DSNRecipient struct {
+	Notify []string // NOTIFY parameter: "NEVER", or any of "SUCCESS", "FAILURE" and "DELAY", or empty if not sent
+	ORcpt  string   // ORCPT parameter including the address type, e.g. "rfc822;user@example.com", decoded from xtext
+}
+
+// Replies holds the text of the replies sent to clients, following the reply code and enhanced status code.
+// The codes are fixed for RFC compliance. Empty fields use the default text.
+// The arguments noted below are inserted in place of "%[1]s", "%[2]s" and so on, e.g. "%[1]s closing connection" omits
+// the application name from the QUIT reply. Any other text, including other percent signs, is sent as is.
+type Replies struct {
+	Banner               string // 220, args: hostname, appname
+	AccessDenied         string // 554 instead of the banner for clients outside AllowedNets or inside DeniedNets, or refused by a ConnectHandler
+	TryLater             string // 421 instead of the banner for clients temporarily refused by a ConnectHandler
+	Greeting             string // 250 for HELO & EHLO, args: hostname, client name
+	HeloArgRequired      string // 501 for HELO & EHLO without a domain or address literal, args: command
+	EarlyPipelining      string // 554 for commands sent before the reply to HELO or EHLO, with RejectEarlyPipelining
+	Quit                 string // 221, args: hostname, appname
+	Timeout              string // 421, args: hostname, appname
+	SessionExpired       string // 421 when MaxSessionDuration is exceeded, args: hostname
+	Ok                   string // 250 for RSET, NOOP & XCLIENT
+	SenderOk             string // 250 for MAIL
+	RecipientOk          string // 250 for RCPT
+	DataPrompt           string // 354
+	Queued               string // 250 after DATA
+	QueuedAs             string // 250 after DATA when a message ID is returned, args: message ID
+	TLSRequired          string // 530
+	AuthRequired         string // 530
+	InvalidFrom          string // 501
+	InvalidSize          string // 501
+	InvalidAuthParam     string // 501
+	InvalidTo            string // 501
+	InvalidRet           string // 501
+	InvalidEnvID         string // 501
+	InvalidNotify        string // 501
+	InvalidORcpt         string // 501
+	PathTooLong          string // 501 for MAIL or RCPT with a path longer than MaxPathLength
+	UnsupportedParameter string // 501 for MAIL or RCPT with an unrecognized parameter when StrictParameters is set
+	HeloRequired         string // 503 for MAIL without HELO or EHLO
+	MailRequired         string // 503 for RCPT without MAIL
+	RcptRequired         string // 503 for DATA without MAIL & RCPT
+	TooManyRecipients    string // 452
+	NotAccepting         string // 421 for MAIL while the server is draining
+	ShuttingDown         string // 421 for MAIL while the server is shutting down
+	TooManyTransactions  string // 421 after the last message allowed by MaxTransactions, args: hostname
+	TooManyIdleCommands  string // 421 when MaxIdleCommands is reached, args: hostname
+	TooManyRcptAttempts  string // 421 for RCPT when MaxRcptAttempts is reached, args: hostname
+	TooManyBytes         string // 552 when MaxBytesPerConnection is exceeded, before closing the connection
+	MailboxUnavailable   string // 550, or RcptRejectCode for RCPT rejected by HandlerRcpt or HandlerRcptWithParams
+	RelayDenied          string // 550 for RCPT to a domain not in AllowedRecipientDomains, an address not accepted by RecipientMatcher, or a domain not in LocalDomains without AllowRelay
+	SenderRejected       string // 550 for MAIL from a domain in BlockedSenderDomains
+	DuplicateRecipient   string // 553
+	LocalError           string // 451 when reading DATA or DKIM signing fails
+	Aborted              string // 451 when DATA is aborted by the server shutting down
+	ProcessingError      string // 451 when a handler fails
+	ParseFailed          string // 451 when a message for a ParsedHandler cannot be parsed
+	MissingHeader        string // 550 for DATA when the message lacks a header listed in RequireHeaders
+	AtrnStarted          string // 250 for ATRN, before the connection is reversed
+	AtrnInTransaction    string // 503
+	EtrnStarted          string // 250 for ETRN, args: node
+	EtrnFailed           string // 458 when a HandlerEtrn fails, args: node
+	EtrnInTransaction    string // 503
+	EtrnArgRequired      string // 501
+	NotImplemented       string // 502
+	CommandDisabled      string // 502 for a command in DisabledCommands
+	Unrecognized         string // 500
+	LineTooLong          string // 500 when a command line exceeds MaxCommandLength
+	BareLF               string // 500 for a command line ending in a bare LF when RequireCRLF is set
+	NoParameters         string // 501 for STARTTLS with parameters
+	StartTLS             string // 220 for STARTTLS
+	TLSInUse             string // 503
+	TLSFailed            string // 403
+	TLSTimeout           string // 403 when the STARTTLS handshake times out
+	AlreadyAuthenticated string // 503
+	AuthInTransaction    string // 503
+	AuthArgRequired      string // 501
+	AuthMechUnrecognized string // 504
+	AuthSuccessful       string // 235
+	AuthInvalid          string // 535
+	TooManyAuthFailures  string // 421 when AuthMaxFailures is reached
+}
+
+var defaultReplies = Replies{
+	Banner:               "%[1]s %[2]s ESMTP Service ready",
+	AccessDenied:         "Access denied",
+	TryLater:             "Service not available, try later",
+	Greeting:             "%[1]s greets %[2]s",
+	HeloArgRequired:      "Syntax: %[1]s hostname",
+	EarlyPipelining:      "Pipelining not allowed before EHLO",
+	Quit:                 "%[1]s %[2]s ESMTP Service closing transmission channel",
+	Timeout:              "%[1]s %[2]s ESMTP Service closing transmission channel after timeout exceeded",
+	SessionExpired:       "%[1]s Service closing transmission channel after maximum session duration exceeded",
+	Ok:                   "Ok",
+	SenderOk:             "Ok",
+	RecipientOk:          "Ok",
+	DataPrompt:           "Start mail input; end with <CR><LF>.<CR><LF>",
+	Queued:               "Ok: queued",
+	QueuedAs:             "Ok: queued as %[1]s",
+	TLSRequired:          "Must issue a STARTTLS command first",
+	AuthRequired:         "Authentication required",
+	InvalidFrom:          "Syntax error in parameters or arguments (invalid FROM parameter)",
+	InvalidSize:          "Syntax error in parameters or arguments (invalid SIZE parameter)",
+	InvalidAuthParam:     "Syntax error in parameters or arguments (invalid AUTH parameter)",
+	InvalidTo:            "Syntax error in parameters or arguments (invalid TO parameter)",
+	InvalidRet:           "Syntax error in parameters or arguments (invalid RET parameter)",
+	InvalidEnvID:         "Syntax error in parameters or arguments (invalid ENVID parameter)",
+	InvalidNotify:        "Syntax error in parameters or arguments (invalid NOTIFY parameter)",
+	InvalidORcpt:         "Syntax error in parameters or arguments (invalid ORCPT parameter)",
+	PathTooLong:          "Syntax error in parameters or arguments (path too long)",
+	UnsupportedParameter: "Unsupported parameter",
+	HeloRequired:         "Send HELO/EHLO first",
+	MailRequired:         "Bad sequence of commands (MAIL required before RCPT)",
+	RcptRequired:         "Bad sequence of commands (MAIL & RCPT required before DATA)",
+	TooManyRecipients:    "Too many recipients",
+	NotAccepting:         "System not accepting messages",
+	ShuttingDown:         "Service shutting down",
+	TooManyTransactions:  "%[1]s Too many messages, closing transmission channel",
+	TooManyIdleCommands:  "%[1]s Too many commands without a message, closing transmission channel",
+	TooManyRcptAttempts:  "%[1]s Too many recipient attempts, closing transmission channel",
+	TooManyBytes:         "Connection byte limit exceeded",
+	MailboxUnavailable:   "Requested action not taken: mailbox unavailable",
+	RelayDenied:          "Relay access denied",
+	SenderRejected:       "Sender rejected",
+	DuplicateRecipient:   "Duplicate recipient",
+	LocalError:           "Requested action aborted: local error in processing",
+	Aborted:              "Requested action aborted: server shutting down",
+	ProcessingError:      "Unable to process mail",
+	ParseFailed:          "Unable to parse message",
+	MissingHeader:        "Message missing required header",
+	AtrnStarted:          "OK now reversing the connection",
+	AtrnInTransaction:    "Bad sequence of commands (ATRN not permitted during mail transaction)",
+	EtrnStarted:          "Queuing for node %[1]s started",
+	EtrnFailed:           "Unable to queue messages for node %[1]s",
+	EtrnInTransaction:    "Bad sequence of commands (ETRN not permitted during mail transaction)",
+	EtrnArgRequired:      "Syntax error (node required)",
+	NotImplemented:       "Command not implemented",
+	CommandDisabled:      "Command disabled",
+	Unrecognized:         "Syntax error, command unrecognized",
+	LineTooLong:          "Line too long",
+	BareLF:               "Line must end with CRLF",
+	NoParameters:         "Syntax error (no parameters allowed)",
+	StartTLS:             "Ready to start TLS",
+	TLSInUse:             "Bad sequence of commands (TLS already in use)",
+	TLSFailed:            "TLS handshake failed",
+	TLSTimeout:           "TLS handshake timed out",
+	AlreadyAuthenticated: "Bad sequence of commands (already authenticated for this session)",
+	AuthInTransaction:    "Bad sequence of commands (AUTH not permitted during mail transaction)",
+	AuthArgRequired:      "Malformed AUTH input (argument required)",
+	AuthMechUnrecognized: "Unrecognized authentication type",
+	AuthSuccessful:       "Authentication successful",
+	AuthInvalid:          "Authentication credentials invalid",
+	TooManyAuthFailures:  "Too many authentication failures",
+}
+
+// Fill in the default text for any replies not configured.
+func (r Replies) withDefaults() *Replies {
+	v := reflect.ValueOf(&r).Elem()
+	d := reflect.ValueOf(defaultReplies)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).String() == "" {
+			v.Field(i).Set(d.Field(i))
+		}
+	}
+	return &r
+}
+
+// Placeholder for an argument in a reply text, e.g. "%[1]s".
+var replyArgPattern = regexp.MustCompile(`%\[([1-9])\]s`)
+
+// Format a reply text, inserting the arguments in place of their placeholders. Placeholders without an argument and
+// any other text, e.g. "100% full", are used as is.
+func formatReply(text string, args ...interface{}) string {
+	if !strings.Contains(text, "%[") {
+		return text
+	}
+	return replyArgPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		i := int(placeholder[2] - '1')
+		if i >= len(args) {
+			return placeholder
+		}
+		return fmt.Sprint(args[i])
+	})
+}
+
 // LogFunc is a function capable of logging the client-server communication.
 type LogFunc func(remoteIP, verb, line string)
 
+// CommandObserver function called with each command received, e.g. for an audit log of the session. The verb is in
+// upper case. Sensitive is set for AUTH, whose arguments may contain credentials which should be redacted.
+// The client's responses during AUTH are not observed.
+type CommandObserver func(md Metadata, verb, args string, sensitive bool)
+
+// ReplyObserver function called with each reply sent, e.g. for an audit log of the session.
+// Multiline replies are passed whole, with the lines separated by CRLF.
+type ReplyObserver func(md Metadata, line string)
+
+// Direction of a line passed to a Tracer.
+type Direction int
+
+const (
+	DirectionIn  Direction = iota // Received from the client, including message data
+	DirectionOut                  // Sent to the client
+)
+
+// Tracer function called with every line received or sent, without the CRLF, e.g. to show a protocol transcript.
+// The connection ID is the one used by the Debug log. Lines are passed as is, including credentials sent during AUTH.
+type Tracer func(connID string, direction Direction, line string)
+
 // Server is an SMTP server.
 type Server struct {
-	Addr              string // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty
-	Appname           string
-	AuthHandler       AuthHandler
-	AuthMechs         map[string]bool // Override list of allowed authentication mechanisms. Currently supported: LOGIN, PLAIN, CRAM-MD5. Enabling LOGIN and PLAIN will reduce RFC 4954 compliance.
-	AuthRequired      bool            // Require authentication for every command except AUTH, EHLO, HELO, NOOP, RSET or QUIT as per RFC 4954. Ignored if AuthHandler is not configured.
-	DisableReverseDNS bool            // Disable reverse DNS lookups, enforces "unknown" hostname
-	Handler           Handler
-	HandlerRcpt       HandlerRcpt
-	Hostname          string
-	LogRead           LogFunc
-	LogWrite          LogFunc
-	MaxSize           int // Maximum message size allowed, in bytes
-	MaxRecipients     int // Maximum number of recipients, defaults to 100.
-	MsgIDHandler      MsgIDHandler
-	Timeout           time.Duration
-	TLSConfig         *tls.Config
-	TLSListener       bool // Listen for incoming TLS connections only (not recommended as it may reduce compatibility). Ignored if TLS is not configured.
-	TLSRequired       bool // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
+	AddEnvelopeHeaders         bool             // Add X-Envelope-From and X-Envelope-To headers with the envelope sender and recipients, e.g. for delivery agents which need them. They reveal every recipient, including blind copies.
+	Addr                       string           // Address to listen on, defaults to ":25" (all addresses, port 25) if empty
+	AfterData                  AfterDataHandler // Called asynchronously after the reply to DATA has been sent
+	AllowedNets                []*net.IPNet     // Accept connections only from these networks, if set
+	AllowedRecipientDomains    []string         // Accept RCPT only for these domains, if not empty
+	AllowEmptyRecipients       bool             // Accept DATA after MAIL without any accepted RCPT, e.g. for testing. See the readme before enabling.
+	AllowRelay                 bool             // Accept RCPT for domains not in LocalDomains from unauthenticated clients
+	Appname                    string
+	AuthFailureDelay           time.Duration // Delay before replying to a failed authentication, to slow password guessing. Cut short by Shutdown.
+	AuthHandler                AuthHandler
+	AuthMaxFailures            int                                 // Failed authentications from an IP address before it is refused with 421 for an hour, unlimited if zero
+	AuthMechs                  map[string]bool                     // Override list of allowed authentication mechanisms. Currently supported: LOGIN, PLAIN, CRAM-MD5, EXTERNAL. Enabling LOGIN and PLAIN will reduce RFC 4954 compliance.
+	AuthRequired               bool                                // Require authentication for every command except AUTH, EHLO, HELO, NOOP, RSET or QUIT as per RFC 4954. Ignored if AuthHandler is not configured.
+	BaseContext                func(conn net.Conn) context.Context // Return the parent context for a session, e.g. with a deadline or tracing. Defaults to context.Background().
+	BlockedSenderDomains       []string                            // Reject MAIL from these domains
+	CommandObserver            CommandObserver                     // Observe every command received, regardless of Debug
+	CommandRateLimit           int                                 // Maximum number of commands per second in a session, after a burst of as many. Commands over the limit, including NOOP, are delayed rather than rejected. Unlimited if zero
+	ConnectHandler             ConnectHandler                      // Refuse clients as they connect, e.g. with a temporary error during maintenance
+	ConnWrapper                func(conn net.Conn) net.Conn        // Wrap each accepted connection, e.g. to limit its rate or log the bytes transferred. The session reads and writes through the returned connection. STARTTLS runs TLS over it, so the wrapper sees encrypted data after STARTTLS, but a connection from a TLSListener is wrapped after TLS, so the wrapper sees plaintext.
+	DataChecker                DataChecker                         // Accept or reject DATA before the message is read
+	DeniedNets                 []*net.IPNet                        // Refuse connections from these networks, even if they are in AllowedNets
+	DisabledCommands           []string                            // Reply 502 to these commands, e.g. "VRFY" or "STARTTLS", and do not list them in the EHLO response
+	DisableEnhancedStatusCodes bool                                // Omit enhanced status codes (RFC 3463) from every reply, and ENHANCEDSTATUSCODES from the EHLO response, for clients which cannot parse them
+	DisableReverseDNS          bool                                // Disable reverse DNS lookups, enforces "unknown" hostname
+	DisableSizeAdvertisement   bool                                // Do not list SIZE in the EHLO response. SIZE parameters are still checked against MaxSize.
+	DKIMSigner                 DKIMSigner                          // Sign messages from authenticated clients before they are handled. Received mail is not altered.
+	Enforce7Bit                bool                                // Reject messages containing 8-bit data unless sent with BODY=8BITMIME
+	ErrorLog                   *log.Logger                         // Log errors such as failed TLS handshakes and handler panics, separately from Debug. Defaults to the log package's standard logger.
+	FlushStrategy              FlushStrategy                       // Send replies to pipelined commands together for throughput, or immediately (the default) for latency
+	GreetingHostname           string                              // Host name for the banner and the reply to HELO or EHLO, e.g. the public name of the server. Defaults to Hostname, which is still used in Received headers.
+	Handler                    Handler
+	HandlerAtrn                HandlerAtrn // Allow authenticated clients to request On-Demand Mail Relay with ATRN, which is not implemented otherwise
+	HandlerEnvelope            HandlerEnvelope
+	HandlerEtrn                HandlerEtrn // Allow clients to request delivery of queued mail with ETRN, which is not implemented otherwise
+	HandlerLMTP                HandlerLMTP // Report the delivery result for each recipient in LMTP mode, taking precedence over the other message handlers
+	HandlerRcpt                HandlerRcpt
+	HandlerRcptBatch           HandlerRcptBatch        // Check all recipients at once on DATA, after each RCPT has been accepted
+	HandlerRcptWithError       HandlerRcptWithError    // Takes precedence over HandlerRcptWithParams and HandlerRcpt
+	HandlerRcptWithMetadata    HandlerRcptWithMetadata // Takes precedence over the other RCPT handlers
+	HandlerRcptWithParams      HandlerRcptWithParams   // Takes precedence over HandlerRcpt
+	HeaderBuilder              HeaderBuilder           // Replaces the default Received header
+	HeaderChecker              HeaderChecker           // Not called for a ReaderHandler or SpillHandler
+	HeloChecker                HeloChecker
+	HelpHandler                HelpHandler // Provide help text for HELP, taking precedence over HelpMessage. HELP is not implemented without either.
+	HelpMessage                string      // Help text for HELP without a HelpHandler, e.g. "See https://example.com/postmaster"
+	HideClientIP               bool        // Omit the client IP address and host name from Received headers, equivalent to ReceivedMinimal
+	HideSoftwareVersion        bool        // Omit Appname from the banner, QUIT and timeout replies, and Received headers
+	Hostname                   string
+	HostnameForConn            func(localAddr net.Addr) string // Host name for the local address of a connection, e.g. for servers with several IP addresses. Falls back to Hostname if empty.
+	LMTP                       bool                            // Speak LMTP (RFC 2033) rather than SMTP: LHLO replaces HELO and EHLO, and DATA has a reply for each recipient. No Received header is added.
+	LocalDomains               []string                        // Domains delivered locally. If set, RCPT for other domains requires authentication or AllowRelay.
+	LogRead                    LogFunc
+	LogWrite                   LogFunc
+	MaxBytesPerConnection      int64           // Maximum number of bytes the client may send, including commands and message data, unlimited if zero. Checked on every line, so a message is cut off as soon as it exceeds the limit.
+	MaxCommandLength           int             // Maximum length of a command line in bytes, including CRLF, defaults to 512
+	MaxDataLineLength          int             // Maximum length of a line of message data in bytes, including CRLF, defaults to 1000
+	MaxDataLines               int             // Maximum number of lines in a message, unlimited if zero
+	MaxIdleCommands            int             // Maximum number of RSET, MAIL, VRFY, EXPN and HELP commands before a message is accepted, unlimited if zero. NOOP is not counted, so clients can use it to keep the session open
+	MaxPathLength              int             // Maximum length of the path in MAIL and RCPT in bytes, including the angle brackets, defaults to 256
+	MaxRcptAttempts            int             // Maximum number of RCPT commands per message, whether accepted or rejected, unlimited if zero
+	MaxSessionDuration         time.Duration   // Maximum duration of a session, however active the client is, unlimited if zero
+	MaxSize                    int             // Maximum message size allowed, in bytes, as sent by the client. Headers added by the server are not counted.
+	MaxRecipients              int             // Maximum number of recipients, defaults to 100.
+	MaxTransactions            int             // Maximum number of messages per connection, after which the connection is closed, unlimited if zero
+	MessageModifier            MessageModifier // Not called for a ReaderHandler or SpillHandler
+	MetadataHandler            MetadataHandler
+	Metrics                    Metrics // Receives counters such as the number of connections and messages. Ignored if nil.
+	MsgIDHandler               MsgIDHandler
+	Network                    string                                   // Network for ListenAndServe to listen on, e.g. "unix" with the path of a socket as Addr, defaults to "tcp"
+	ParsedHandler              ParsedHandler                            // Only called if none of the other message handlers is set
+	ProxyProtocolAllowed       []string                                 // IP addresses of proxies which send a PROXY protocol (v1 or v2) header, e.g. HAProxy or an AWS NLB. Not supported with TLSListener.
+	RcptRejectCode             string                                   // Reply code and enhanced status code sent when HandlerRcpt or HandlerRcptWithParams rejects a recipient, e.g. "450 4.2.0" for a temporary failure, defaults to "550 5.1.0"
+	RcptRewriter               RcptRewriter                             // Canonicalize recipient addresses before they are checked and stored
+	ReaderHandler              ReaderHandler                            // Takes precedence over the other handlers, as it reads the message as it is received
+	ReceivedHeaderMode         ReceivedHeaderMode                       // Ignored if a HeaderBuilder is set
+	RecipientMatcher           RecipientMatcher                         // Accept RCPT only for addresses it accepts, if set, e.g. a GlobMatcher or RegexpMatcher
+	RejectDuplicateRcpt        bool                                     // Reject a RCPT for a recipient already accepted in the transaction
+	RejectEarlyPipelining      bool                                     // Disconnect clients which send further commands before reading the reply to their first HELO or EHLO, as spam software often does
+	Replies                    Replies                                  // Override the text of replies sent to clients
+	ReplyObserver              ReplyObserver                            // Observe every reply sent, regardless of Debug
+	ReportMessageSize          bool                                     // Include the size of accepted messages in the reply to DATA, e.g. "(12345 bytes)"
+	RequireCRLF                bool                                     // Reject command lines ending in a bare LF rather than CRLF, as RFC 5321 requires. They are accepted otherwise.
+	RequireHeaders             []string                                 // Reject messages lacking any of these headers with 550, e.g. "From" and "Date" as RFC 5322 requires. Not checked for a ReaderHandler or SpillHandler.
+	RequireHelo                bool                                     // Require HELO or EHLO before MAIL
+	Resolver                   func(ip string) (host string, err error) // Look up the host name of a client for the Received header, e.g. with a cache, in place of reverse DNS
+	ReusePort                  bool                                     // Set SO_REUSEPORT on the socket opened by ListenAndServe, so a new process can listen on the same port before the old one stops. Listening fails on platforms without it.
+	SenderChecker              SenderChecker
+	SessionEndHandler          SessionEndHandler
+	SizeAdvertiser             SizeAdvertiser // Compute the size listed with SIZE in the EHLO reply, which defaults to the maximum message size
+	SMTPSTLSConfig             *tls.Config    // TLS configuration for a TLSListener, e.g. for a different certificate on port 465. Defaults to TLSConfig.
+	SpillHandler               SpillHandler   // Takes precedence over the other handlers except ReaderHandler, as it reads the message as it is received
+	SpillToDiskThreshold       int            // Size in bytes above which a message for a SpillHandler is written to a temporary file, defaults to 1 MiB
+	StrictDataTermination      bool           // Reject messages containing a bare CR or LF, which other servers may take for a line ending, e.g. in the end of the data (SMTP smuggling)
+	StrictParameters           bool           // Reject MAIL and RCPT with parameters the server does not support, rather than ignoring them
+	Submission                 bool           // Message submission mode (RFC 6409) on port 587 by default: require authentication for MAIL, and add missing Date and Message-ID headers unless a ReaderHandler or SpillHandler is used
+	Timeout                    time.Duration
+	TLSConfig                  *tls.Config
+	TLSHandshakeTimeout        time.Duration // Maximum duration of the STARTTLS handshake, defaults to Timeout
+	TLSListener                bool          // Listen for incoming TLS connections only (not recommended as it may reduce compatibility). Ignored if neither TLSConfig nor SMTPSTLSConfig is set.
+	TLSRequired                bool          // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
+	Trace                      Tracer        // Observe every line received and sent, regardless of Debug
 
 	inShutdown   int32 // server was closed or shutdown
+	draining     int32 // new mail transactions are refused
 	openSessions int32 // count of open sessions
 	mu           sync.Mutex
-	shutdownChan chan struct{} // let the sessions know we are shutting down
+	configMu     sync.RWMutex    // guards the fields which can be changed while serving with the Set methods
+	shutdownChan chan struct{}   // let the sessions know we are shutting down
+	abortCtx     context.Context // cancelled when sessions must abort, e.g. the shutdown deadline has passed
+	abortFunc    context.CancelFunc
+	listenAddr   net.Addr                   // address of the listener passed to Serve
+	listening    chan struct{}              // closed once Serve has been called
+	listeners    map[*net.Listener]struct{} // listeners passed to Serve, closed by Close and Shutdown
+	now          func() time.Time           // replaced in tests, defaults to time.Now
+	authFailures authFailures               // failed authentications by IP address, for AuthMaxFailures
+	middleware   []HandlerFunc              // registered with Use, in order
 
 	XClientAllowed []string // List of XCLIENT allowed IP addresses
 }
@@ -155,8 +754,19 @@ func (srv *Server) ConfigureTLSWithPassphrase(
 	return nil
 }
 
-// ListenAndServe listens on the TCP network address srv.Addr and then
-// calls Serve to handle requests on incoming connections.  If
+// ConfigureTLSWithConfig sets a TLS configuration which supplies its own certificates, e.g. one from
+// golang.org/x/crypto/acme/autocert with a GetCertificate function. It is safe to call while the server is running.
+// Returns an error if the configuration has no certificates and no function to get them.
+func (srv *Server) ConfigureTLSWithConfig(config *tls.Config) error {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil) {
+		return errors.New("smtpd: TLS configuration has no certificates")
+	}
+	srv.SetTLSConfig(config)
+	return nil
+}
+
+// ListenAndServe listens on the network address srv.Addr, over TCP unless srv.Network is set,
+// and then calls Serve to handle requests on incoming connections.  If
 // srv.Addr is blank, ":25" is used.
 func (srv *Server) ListenAndServe() error {
 	if atomic.LoadInt32(&srv.inShutdown) != 0 {
@@ -165,6 +775,9 @@ func (srv *Server) ListenAndServe() error {
 
 	if srv.Addr == "" {
 		srv.Addr = ":25"
+		if srv.Submission {
+			srv.Addr = ":587"
+		}
 	}
 	if srv.Appname == "" {
 		srv.Appname = "smtpd"
@@ -176,28 +789,58 @@ func (srv *Server) ListenAndServe() error {
 		srv.Timeout = 5 * time.Minute
 	}
 
-	var ln net.Listener
-	var err error
-
-	// If TLSListener is enabled, listen for TLS connections only.
-	if srv.TLSConfig != nil && srv.TLSListener {
-		ln, err = tls.Listen("tcp", srv.Addr, srv.TLSConfig)
-	} else {
-		ln, err = net.Listen("tcp", srv.Addr)
+	var lc net.ListenConfig
+	if srv.ReusePort {
+		lc.Control = reusePortControl
 	}
+	network := srv.Network
+	if network == "" {
+		network = "tcp"
+	}
+	ln, err := lc.Listen(context.Background(), network, srv.Addr)
 	if err != nil {
 		return err
 	}
+
+	// If TLSListener is enabled, listen for TLS connections only.
+	if config := srv.implicitTLSConfig(); config != nil && srv.TLSListener {
+		// Look up the configuration for each connection, so it can be changed with SetTLSConfig.
+		config = &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return srv.implicitTLSConfig(), nil
+		}}
+		ln = tls.NewListener(ln, config)
+	}
+	return srv.Serve(ln)
+}
+
+// Return the TLS configuration for connections to a TLSListener, which may differ from the one for STARTTLS.
+func (srv *Server) implicitTLSConfig() *tls.Config {
+	if srv.SMTPSTLSConfig != nil {
+		return srv.SMTPSTLSConfig
+	}
+	return srv.tlsConfig()
+}
+
+// ServeLMTP serves LMTP (RFC 2033) on ln, e.g. a Unix socket for a delivery agent behind a front-end MTA such as
+// Dovecot or Postfix, by setting LMTP and calling Serve. No Received header is added in LMTP mode, as the front-end
+// MTA has already added one.
+func (srv *Server) ServeLMTP(ln net.Listener) error {
+	srv.LMTP = true
 	return srv.Serve(ln)
 }
 
 // Serve creates a new SMTP session after a network connection is established.
+// The listener may be created by the caller, e.g. wrapped for TLS or to limit the rate of connections. Serve closes
+// it when returning, and Close and Shutdown close it to stop accepting connections.
 func (srv *Server) Serve(ln net.Listener) error {
-	if atomic.LoadInt32(&srv.inShutdown) != 0 {
+	defer ln.Close()
+	if !srv.trackListener(&ln, true) {
 		return ErrServerClosed
 	}
+	defer srv.trackListener(&ln, false)
+	srv.setListenerAddr(ln.Addr())
 
-	defer ln.Close()
+	var tempDelay time.Duration // How long to sleep on accept failure.
 	for {
 
 		// if we are shutting down, don't accept new connections
@@ -209,11 +852,34 @@ func (srv *Server) Serve(ln net.Listener) error {
 
 		conn, err := ln.Accept()
 		if err != nil {
+			// The listener is closed by Close and Shutdown.
+			select {
+			case <-srv.getShutdownChan():
+				return ErrServerClosed
+			default:
+			}
+			// Back off exponentially on temporary errors (e.g. running out of file descriptors),
+			// rather than spinning on Accept, as net/http does.
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				srv.logf("smtpd: Accept error: %v; retrying in %v", err, tempDelay)
+				select {
+				case <-time.After(tempDelay):
+				case <-srv.getShutdownChan():
+					return ErrServerClosed
+				}
 				continue
 			}
 			return err
 		}
+		tempDelay = 0
 
 		session := srv.newSession(conn)
 		atomic.AddInt32(&srv.openSessions, 1)
@@ -221,53 +887,320 @@ func (srv *Server) Serve(ln net.Listener) error {
 	}
 }
 
+// Return the current time, from the clock replaced in tests if set.
+// Connection deadlines always use the real time, as they are compared against it by the network poller.
+func (srv *Server) currentTime() time.Time {
+	if srv.now != nil {
+		return srv.now()
+	}
+	return time.Now()
+}
+
+// Log an internal server condition to the ErrorLog, if set.
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Log an internal condition of the session, with the connection ID.
+func (s *session) logf(format string, args ...interface{}) {
+	s.srv.logf("smtpd: [%s] "+format, append([]interface{}{s.id}, args...)...)
+}
+
+// Context key for the connection ID.
+type connectionIDKey struct{}
+
+// ConnectionID returns the random ID of the connection a handler is called for, from the Context in its Metadata,
+// or an empty string if there is none. The ID is included in the server's log entries for the connection.
+func ConnectionID(ctx context.Context) string {
+	id, _ := ctx.Value(connectionIDKey{}).(string)
+	return id
+}
+
+// Context key for the username of an authenticated client.
+type authUsernameKey struct{}
+
+// AuthUsername returns the username the client authenticated as, from the Context in the Metadata of a handler,
+// and whether the client has authenticated.
+func AuthUsername(ctx context.Context) (username string, ok bool) {
+	username, ok = ctx.Value(authUsernameKey{}).(string)
+	return username, ok
+}
+
+// Return a short random ID for a connection.
+func newConnectionID() string {
+	id := make([]byte, 6)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
 type session struct {
 	srv           *Server
+	id            string // Random connection ID, to correlate log entries and messages with the session
 	conn          net.Conn
 	br            *bufio.Reader
 	bw            *bufio.Writer
+	localHostname string // Host name for the local address, overriding the server host name
 	remoteIP      string // Remote IP address
 	remoteHost    string // Remote hostname according to reverse DNS lookup
 	remoteName    string // Remote hostname as supplied with EHLO
+	greeted       bool   // HELO or EHLO has been accepted
 	xClient       string // Information string as supplied with XCLIENT
 	xClientADDR   string // Information string as supplied with XCLIENT ADDR
 	xClientNAME   string // Information string as supplied with XCLIENT NAME
 	xClientTrust  bool   // Trust XCLIENT from current IP address
 	tls           bool
+	tlsState      *tls.ConnectionState // Negotiated TLS parameters, recorded for the Received header
+	listenerTLS   *tls.Conn            // Connection accepted by a TLSListener, beneath any ConnWrapper
 	authenticated bool
+	authUsername  string // Username the client authenticated as
+	limitsMu      sync.Mutex
+	limits        Limits // Overrides of the server limits, set by handlers with SetLimits and guarded by limitsMu
+	transactions  int    // Number of messages accepted
+	idleCommands  int    // Number of commands counted against MaxIdleCommands since a message was last accepted
+	replyTexts    *Replies
+	start         time.Time // When the connection was accepted
+	deadline      time.Time // When the session must end, set by MaxSessionDuration
+	commandTime   time.Time // When the last command was due by the CommandRateLimit
+	ctx           context.Context
+	cancel        context.CancelFunc
+	bytesIn       int64 // Bytes read from the client, including message data
+	afterBareLF   bool  // The last line of message data read ended with a bare LF, so a lone period does not end the data
+	bytesOut      int64 // Bytes written to the client
+	writeErr      error // First error writing to the client, which ends the session
+	endReason     EndReason
+
+	// Current mail transaction.
+	from       string
+	gotFrom    bool
+	to         []string
+	toSent     []string          // Recipients as sent by the client, before any RcptRewriter
+	rcptErrs   []error           // Result of HandlerRcptBatch for each recipient during DATA in LMTP mode, nil if accepted
+	allTo      []string          // Recipients including those rejected by HandlerRcptBatch, restored after DATA
+	allToSent  []string          // As toSent, including those rejected by HandlerRcptBatch
+	allDSN     []DSNRecipient    // As dsn.Recipients, including those rejected by HandlerRcptBatch
+	rcptCount  int               // RCPT commands since MAIL, including rejected ones
+	params     map[string]string // Parameters sent with MAIL
+	authSender string            // Mailbox asserted with the MAIL AUTH parameter by a trusted client
+	dsn        DSN
+	buffer     bytes.Buffer
+}
+
+// Use a connection for the session, counting the bytes transferred.
+func (s *session) setConn(conn net.Conn) {
+	s.conn = conn
+	s.br = bufio.NewReader(countingReader{conn, &s.bytesIn})
+	s.bw = bufio.NewWriter(countingWriter{conn, &s.bytesOut})
+}
+
+// countingReader counts the bytes read from a connection.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// bufferedConn is a connection which reads from a buffered reader, so buffered data is not lost.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// countingWriter counts the bytes written to a connection.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
 }
 
 // Create new session from connection.
 func (srv *Server) newSession(conn net.Conn) (s *session) {
 	s = &session{
-		srv:  srv,
-		conn: conn,
-		br:   bufio.NewReader(conn),
-		bw:   bufio.NewWriter(conn),
+		srv:   srv,
+		id:    newConnectionID(),
+		start: srv.currentTime(),
+	}
+	// A connection accepted by a TLSListener is using TLS, even once it has been wrapped.
+	s.listenerTLS, s.tls = conn.(*tls.Conn)
+	if srv.ConnWrapper != nil {
+		conn = srv.ConnWrapper(conn)
+	}
+	s.setConn(conn)
+
+	// Derive the session context, which is cancelled when the session ends.
+	ctx := context.Background()
+	if srv.BaseContext != nil {
+		ctx = srv.BaseContext(conn)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.WithValue(ctx, connectionIDKey{}, s.id))
+
+	// Determine the host name presented on this connection.
+	if srv.HostnameForConn != nil {
+		s.localHostname = srv.HostnameForConn(conn.LocalAddr())
 	}
 
 	// Get remote end info for the Received header.
-	s.remoteIP, _, _ = net.SplitHostPort(s.conn.RemoteAddr().String())
-	if !s.srv.DisableReverseDNS {
-		names, err := net.LookupAddr(s.remoteIP)
-		if err == nil && len(names) > 0 {
-			s.remoteHost = names[0]
+	// Connections which are not over TCP, e.g. from net.Pipe or a Unix socket, have no address to look up.
+	// The client of a trusted proxy is only known once the PROXY protocol header has been read.
+	s.remoteIP, s.remoteHost = "unknown", "unknown"
+	if host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String()); err == nil && host != "" {
+		if srv.proxyAllowed(host) {
+			s.remoteIP = host
 		} else {
-			s.remoteHost = "unknown"
+			s.setRemoteIP(host)
 		}
-	} else {
-		s.remoteHost = "unknown"
 	}
 
-	// Set tls = true if TLS is already in use.
-	_, s.tls = s.conn.(*tls.Conn)
+	// Connection deadlines always use the real time, as they are compared against it by the network poller.
+	if srv.MaxSessionDuration > 0 {
+		s.deadline = time.Now().Add(srv.MaxSessionDuration)
+	}
+	return
+}
 
-	for _, checkIP := range srv.XClientAllowed {
-		if s.remoteIP == checkIP {
+// Use ip as the address of the client, looking up its host name and whether it is trusted to send XCLIENT.
+func (s *session) setRemoteIP(ip string) {
+	s.remoteIP = ip
+	if !s.srv.DisableReverseDNS {
+		s.remoteHost = s.srv.lookupHost(ip)
+	}
+	s.xClientTrust = false
+	for _, checkIP := range s.srv.XClientAllowed {
+		if ip == checkIP {
 			s.xClientTrust = true
 		}
 	}
-	return
+}
+
+// Report whether ip is a trusted proxy, which sends a PROXY protocol header.
+func (srv *Server) proxyAllowed(ip string) bool {
+	for _, proxyIP := range srv.ProxyProtocolAllowed {
+		if ip == proxyIP {
+			return true
+		}
+	}
+	return false
+}
+
+// Read the PROXY protocol header sent by a trusted proxy, and use the addresses of the original connection.
+func (s *session) readProxyHeader() error {
+	s.setReadDeadline()
+	src, dst, err := readProxyHeader(s.br)
+	if err != nil {
+		return err
+	}
+	// A header without addresses is sent for connections from the proxy itself, e.g. health checks.
+	if src == nil {
+		s.setRemoteIP(s.remoteIP)
+		return nil
+	}
+	s.conn = &proxyConn{Conn: s.conn, remoteAddr: src, localAddr: dst}
+	s.setRemoteIP(src.(*net.TCPAddr).IP.String())
+	return nil
+}
+
+// Maximum duration of a reverse DNS lookup when no Resolver is set.
+const reverseDNSTimeout = 5 * time.Second
+
+// Look up the host name of an IP address with the Resolver, or with reverse DNS if none is set.
+// Returns "unknown" if the lookup fails.
+func (srv *Server) lookupHost(ip string) string {
+	if srv.Resolver != nil {
+		host, err := srv.Resolver(ip)
+		if err != nil || host == "" {
+			return "unknown"
+		}
+		return host
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reverseDNSTimeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return "unknown"
+	}
+	return names[0]
+}
+
+// ListenerAddr returns the network address the server is listening on, or nil if it is not listening yet.
+// When srv.Addr uses port 0, this is the port assigned by the operating system.
+func (srv *Server) ListenerAddr() net.Addr {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.listenAddr
+}
+
+// Listening returns a channel which is closed once the server is listening, after which ListenerAddr is set.
+func (srv *Server) Listening() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listening == nil {
+		srv.listening = make(chan struct{})
+	}
+	return srv.listening
+}
+
+func (srv *Server) setListenerAddr(addr net.Addr) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.listenAddr = addr
+	if srv.listening == nil {
+		srv.listening = make(chan struct{})
+	}
+
+	select {
+	case <-srv.listening:
+	default:
+		close(srv.listening)
+	}
+}
+
+// Add or remove a listener passed to Serve. Returns false if the server is shutting down, so the listener is not added.
+func (srv *Server) trackListener(ln *net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !add {
+		delete(srv.listeners, ln)
+		return true
+	}
+	if atomic.LoadInt32(&srv.inShutdown) != 0 {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[*net.Listener]struct{})
+	}
+	srv.listeners[ln] = struct{}{}
+	return true
+}
+
+// Close the listeners passed to Serve, returning the first error.
+func (srv *Server) closeListeners() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var err error
+	for ln := range srv.listeners {
+		if cerr := (*ln).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 func (srv *Server) getShutdownChan() <-chan struct{} {
@@ -294,263 +1227,1121 @@ func (srv *Server) closeShutdownChan() {
 	}
 }
 
-// Close - closes the connection without waiting
-func (srv *Server) Close() error {
-	atomic.StoreInt32(&srv.inShutdown, 1)
-	srv.closeShutdownChan()
-	return nil
+// Return a context which is cancelled when sessions must abort any message transfer in progress.
+func (srv *Server) getAbortContext() context.Context {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.abortCtx == nil {
+		srv.abortCtx, srv.abortFunc = context.WithCancel(context.Background())
+	}
+
+	return srv.abortCtx
 }
 
-// Shutdown - waits for current sessions to complete before closing
-func (srv *Server) Shutdown(ctx context.Context) error {
-	atomic.StoreInt32(&srv.inShutdown, 1)
-	srv.closeShutdownChan()
+func (srv *Server) abortSessions() {
+	srv.getAbortContext()
+	srv.abortFunc()
+}
 
-	// wait for up to 30 seconds to allow the current sessions to
-	// end
-	timer := time.NewTimer(100 * time.Millisecond)
-	defer timer.Stop()
+// Use adds a HandlerFunc to the chain called for each received email, after those already added and before the
+// handler, which is the last in the chain. It must be called before the server starts.
+func (srv *Server) Use(h HandlerFunc) {
+	srv.middleware = append(srv.middleware, h)
+}
 
-	for i := 0; i < 300; i++ {
+// SetDraining sets whether new mail transactions are refused, e.g. before a restart for maintenance.
+// While draining, MAIL is rejected with a 421 reply and the connection is closed, but transactions in progress can
+// finish and other commands are still accepted until the client sends MAIL.
+func (srv *Server) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&srv.draining, v)
+}
 
-		// wait for open sessions to close
-		if atomic.LoadInt32(&srv.openSessions) == 0 {
-			break
-		}
+// SetTLSConfig replaces the TLS configuration used for new TLS connections, e.g. to rotate certificates without
+// restarting the server. Unlike setting TLSConfig directly, it is safe to call while the server is running.
+func (srv *Server) SetTLSConfig(config *tls.Config) {
+	srv.configMu.Lock()
+	defer srv.configMu.Unlock()
+	srv.TLSConfig = config
+}
 
-		select {
-		case <-timer.C:
-			timer.Reset(100 * time.Millisecond)
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-	}
+// SetHandler replaces the handler for messages received after it returns.
+// Unlike setting Handler directly, it is safe to call while the server is running.
+func (srv *Server) SetHandler(handler Handler) {
+	srv.configMu.Lock()
+	defer srv.configMu.Unlock()
+	srv.Handler = handler
+}
 
-	return nil
+// SetMaxSize replaces the maximum message size for commands received after it returns.
+// Unlike setting MaxSize directly, it is safe to call while the server is running.
+func (srv *Server) SetMaxSize(size int) {
+	srv.configMu.Lock()
+	defer srv.configMu.Unlock()
+	srv.MaxSize = size
 }
 
-// Function called to handle connection requests.
-func (s *session) serve() {
-	defer atomic.AddInt32(&s.srv.openSessions, -1)
-	defer s.conn.Close()
+func (srv *Server) tlsConfig() *tls.Config {
+	srv.configMu.RLock()
+	defer srv.configMu.RUnlock()
+	return srv.TLSConfig
+}
 
-	var from string
-	var gotFrom bool
-	var to []string
-	var buffer bytes.Buffer
+func (srv *Server) handler() Handler {
+	srv.configMu.RLock()
+	defer srv.configMu.RUnlock()
+	return srv.Handler
+}
 
-	// Send banner.
-	s.writef("220 %s %s ESMTP Service ready", s.srv.Hostname, s.srv.Appname)
+func (srv *Server) maxSize() int {
+	srv.configMu.RLock()
+	defer srv.configMu.RUnlock()
+	return srv.MaxSize
+}
 
-loop:
-	for {
-		// Attempt to read a line from the socket.
-		// On timeout, send a timeout message and return from serve().
-		// On error, assume the client has gone away i.e. return from serve().
-		line, err := s.readLine()
+// ParseNets parses a list of networks in CIDR notation, e.g. "192.0.2.0/24" or "2001:db8::/32",
+// for use in AllowedNets or DeniedNets.
+func ParseNets(cidrs ...string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
-			}
-			break
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// MustParseNets is like ParseNets but panics if a network cannot be parsed.
+func MustParseNets(cidrs ...string) []*net.IPNet {
+	nets, err := ParseNets(cidrs...)
+	if err != nil {
+		panic("smtpd: " + err.Error())
+	}
+	return nets
+}
+
+// Report whether an IP address is allowed to connect. Denied networks take precedence over allowed networks.
+func ipAllowed(ip net.IP, allowed []*net.IPNet, denied []*net.IPNet) bool {
+	for _, ipNet := range denied {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, ipNet := range allowed {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close - closes the listeners and the connection without waiting
+func (srv *Server) Close() error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	srv.closeShutdownChan()
+	err := srv.closeListeners()
+	srv.abortSessions()
+	return err
+}
+
+// Shutdown - waits for current sessions to complete before closing.
+// If ctx is done first, message transfers still in progress are aborted with a 451 reply and ctx.Err() is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	srv.closeShutdownChan()
+	srv.closeListeners()
+
+	// Check for open sessions every 100ms until they have all ended.
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt32(&srv.openSessions) != 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			// Abort any message transfers still in progress, rather than waiting on slow clients.
+			srv.abortSessions()
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Reset the mail transaction state.
+func (s *session) reset() {
+	s.from = ""
+	s.gotFrom = false
+	s.to = nil
+	s.toSent = nil
+	s.rcptErrs = nil
+	s.allTo = nil
+	s.allToSent = nil
+	s.allDSN = nil
+	s.rcptCount = 0
+	s.params = nil
+	s.authSender = ""
+	s.dsn = DSN{}
+	s.buffer.Reset()
+}
+
+// Return the envelope of the current mail transaction.
+func (s *session) envelope() *Envelope {
+	env := &Envelope{From: s.from, To: s.to, Params: s.params, Data: s.buffer.Bytes()}
+	env.Size, _ = strconv.Atoi(s.params["SIZE"])
+	return env
+}
+
+// Pass a received message through the HandlerFuncs added with Use to the configured handler. A panicking handler
+// results in an error rather than crashing the server, and the panic is logged with the stack trace.
+func (s *session) handle(env *Envelope) (msgID string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf("Handler panic: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+
+	if len(s.srv.middleware) == 0 {
+		return s.callHandler(env)
+	}
+	md := s.metadata()
+	var next func(i int) error
+	next = func(i int) error {
+		if i == len(s.srv.middleware) {
+			var err error
+			msgID, err = s.callHandler(env)
+			return err
+		}
+		return s.srv.middleware[i](md, env, func() error { return next(i + 1) })
+	}
+	err = next(0)
+	return msgID, err
+}
+
+// Call the configured handler, if any.
+func (s *session) callHandler(env *Envelope) (msgID string, err error) {
+	handler := s.srv.handler()
+	switch {
+	case handler != nil:
+		err = handler(s.conn.RemoteAddr(), env.From, env.To, env.Data)
+	case s.srv.MsgIDHandler != nil:
+		msgID, err = s.srv.MsgIDHandler(s.conn.RemoteAddr(), env.From, env.To, env.Data)
+	case s.srv.MetadataHandler != nil:
+		err = s.srv.MetadataHandler(s.metadata(), env.From, env.To, env.Data)
+	case s.srv.HandlerEnvelope != nil:
+		err = s.srv.HandlerEnvelope(s.metadata(), env)
+	case s.srv.ParsedHandler != nil:
+		var msg *mail.Message
+		if msg, err = mail.ReadMessage(bytes.NewReader(env.Data)); err != nil {
+			err = &Error{Code: 451, EnhancedCode: "4.3.0", Message: formatReply(s.replies().ParseFailed)}
+			break
+		}
+		err = s.srv.ParsedHandler(s.metadata(), env.From, env.To, msg)
+	}
+	return msgID, err
+}
+
+// Deliver a received message with the HandlerLMTP, returning the result for each recipient.
+// A panicking handler results in an error for every recipient, as for handle.
+func (s *session) handleLMTP(env *Envelope) (errs []error) {
+	errs = make([]error, len(env.To))
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf("Handler panic: %v\n%s", r, debug.Stack())
+			for i := range errs {
+				errs[i] = fmt.Errorf("handler panic: %v", r)
+			}
+		}
+	}()
+
+	for i, err := range s.srv.HandlerLMTP(s.metadata(), env) {
+		if i < len(errs) && err != nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// Return the number of replies to send after the message data: one for each recipient in LMTP mode
+// (RFC 2033 section 4.2), otherwise one.
+func (s *session) dataReplies() int {
+	if s.srv.LMTP && len(s.to) > 0 {
+		return len(s.to)
+	}
+	return 1
+}
+
+// Reply to the message data with an error, for each recipient in LMTP mode.
+// Returns true if the connection must be closed.
+func (s *session) writeDataError(err error) bool {
+	return s.writeDataReplies(func(int) bool {
+		return s.writeHandlerError(err)
+	})
+}
+
+// Send the replies to the message data, calling reply for each with the index of its recipient in s.to. In LMTP mode,
+// the error for each recipient rejected by HandlerRcptBatch is sent in its place, keeping the replies in RCPT order.
+// Returns true if any reply closes the connection.
+func (s *session) writeDataReplies(reply func(i int) bool) bool {
+	closing := false
+	if s.rcptErrs == nil {
+		for i := 0; i < s.dataReplies(); i++ {
+			if reply(i) {
+				closing = true
+			}
+		}
+		return closing
+	}
+	i := 0
+	for _, err := range s.rcptErrs {
+		if err != nil {
+			if s.writeHandlerError(err) {
+				closing = true
+			}
+			continue
+		}
+		if reply(i) {
+			closing = true
+		}
+		i++
+	}
+	return closing
+}
+
+// Check the recipients with the HandlerRcptBatch on DATA. In LMTP mode the rejected recipients are left out of the
+// transaction until the DATA command has been handled, otherwise any rejection rejects the DATA command.
+// Returns false if the DATA command has been rejected, and closing true if the connection must be closed.
+func (s *session) checkRcptBatch() (ok bool, closing bool) {
+	results := s.srv.HandlerRcptBatch(s.metadata(), s.from, s.to)
+	errs := make([]error, len(s.to))
+	var to, toSent []string
+	var dsnRcpts []DSNRecipient
+	var firstErr error
+	for i, rcpt := range s.to {
+		if err := results[rcpt]; err != nil {
+			errs[i] = err
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		to = append(to, rcpt)
+		toSent = append(toSent, s.toSent[i])
+		dsnRcpts = append(dsnRcpts, s.dsn.Recipients[i])
+	}
+	if firstErr == nil {
+		return true, false
+	}
+	if !s.srv.LMTP || len(to) == 0 {
+		return false, s.writeHandlerError(firstErr)
+	}
+	s.rcptErrs = errs
+	s.allTo, s.allToSent, s.allDSN = s.to, s.toSent, s.dsn.Recipients
+	s.to, s.toSent, s.dsn.Recipients = to, toSent, dsnRcpts
+	return true, false
+}
+
+// Refuse the client in place of the banner, after the ConnectHandler returned err.
+func (s *session) refuseConnection(err error) {
+	code, enhancedCode, text := "421", "4.3.2", s.replies().TryLater
+	var smtpErr *Error
+	if errors.As(err, &smtpErr) && !smtpErr.Temporary() {
+		code, enhancedCode, text = "554", "5.7.1", s.replies().AccessDenied
+	}
+	if smtpErr != nil && smtpErr.EnhancedCode != "" {
+		enhancedCode = smtpErr.EnhancedCode
+	}
+	if smtpErr != nil && smtpErr.Message != "" {
+		text = smtpErr.Message
+	}
+	lines := strings.Split(strings.TrimRight(text, "\r\n"), "\n")
+	for i, line := range lines {
+		lines[i] = enhancedCode + " " + strings.TrimRight(line, "\r")
+	}
+	s.writeMultiline(code, lines)
+}
+
+// Return the reply code sent when HandlerRcpt or HandlerRcptWithParams rejects a recipient.
+func (s *session) rcptRejectCode() string {
+	if s.srv.RcptRejectCode != "" {
+		return s.srv.RcptRejectCode
+	}
+	return "550 5.1.0"
+}
+
+// Return the error sent when the message data cannot be processed due to a local problem.
+func (s *session) localError() error {
+	return &Error{Code: 451, EnhancedCode: "4.3.0", Message: formatReply(s.replies().LocalError)}
+}
+
+// Return the overrides of the server limits set by handlers.
+func (s *session) getLimits() Limits {
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	return s.limits
+}
+
+// Override the server limits, for Metadata.SetLimits.
+func (s *session) setLimits(limits Limits) {
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	s.limits = limits
+}
+
+// Return the maximum message size for the session, which handlers may override.
+func (s *session) maxSize() int {
+	if limits := s.getLimits(); limits.MaxSize != 0 {
+		return limits.MaxSize
+	}
+	return s.srv.maxSize()
+}
+
+// Report whether message data must be 7-bit, as Enforce7Bit is set and the client did not send BODY=8BITMIME.
+func (s *session) requires7Bit() bool {
+	return s.srv.Enforce7Bit && !strings.EqualFold(s.params["BODY"], "8BITMIME")
+}
+
+// Report whether a line contains any octet with the high bit set.
+func has8Bit(line []byte) bool {
+	for _, c := range line {
+		if c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether a command is in DisabledCommands.
+func (s *session) commandDisabled(verb string) bool {
+	for _, disabled := range s.srv.DisabledCommands {
+		if strings.EqualFold(disabled, verb) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the maximum length of a command line.
+// RFC 5321 section 4.5.3.1.4 specifies a maximum of 512 octets, including the CRLF.
+func (s *session) maxCommandLength() int {
+	if s.srv.MaxCommandLength > 0 {
+		return s.srv.MaxCommandLength
+	}
+	return 512
+}
+
+// Return the maximum length of a line of message data.
+// RFC 5321 section 4.5.3.1.6 specifies a maximum of 1000 octets, including the CRLF.
+func (s *session) maxDataLineLength() int {
+	if s.srv.MaxDataLineLength > 0 {
+		return s.srv.MaxDataLineLength
+	}
+	return 1000
+}
+
+// Return the maximum length of a reverse-path or forward-path.
+// RFC 5321 section 4.5.3.1.3 specifies a maximum of 256 octets, including the angle brackets.
+func (s *session) maxPathLength() int {
+	if s.srv.MaxPathLength > 0 {
+		return s.srv.MaxPathLength
+	}
+	return 256
+}
+
+// Return the maximum number of recipients for the session, which handlers may override.
+// RFC 5321 specifies support for minimum of 100 recipients is required.
+func (s *session) maxRecipients() int {
+	if limits := s.getLimits(); limits.MaxRecipients != 0 {
+		return limits.MaxRecipients
+	}
+	if s.srv.MaxRecipients != 0 {
+		return s.srv.MaxRecipients
+	}
+	return 100
+}
+
+// Return the maximum duration of the STARTTLS handshake.
+func (s *session) tlsHandshakeTimeout() time.Duration {
+	if s.srv.TLSHandshakeTimeout > 0 {
+		return s.srv.TLSHandshakeTimeout
+	}
+	return s.srv.Timeout
+}
+
+// Report the bytes read to the Metrics and call the SessionEndHandler, if configured, once the connection has been closed.
+func (s *session) end() {
+	if s.srv.Metrics != nil {
+		s.srv.Metrics.AddBytesIn(s.bytesIn)
+	}
+	if s.srv.SessionEndHandler == nil {
+		return
+	}
+	s.srv.SessionEndHandler(s.metadata(), SessionSummary{
+		BytesIn:  s.bytesIn,
+		BytesOut: s.bytesOut,
+		Duration: s.srv.currentTime().Sub(s.start),
+		Reason:   s.endReason,
+	})
+}
+
+// Return the host name presented to the client.
+func (s *session) hostname() string {
+	if s.localHostname != "" {
+		return s.localHostname
+	}
+	return s.srv.Hostname
+}
+
+// Return the host name sent in the banner and the reply to HELO or EHLO.
+func (s *session) greetingHostname() string {
+	if s.srv.GreetingHostname != "" {
+		return s.srv.GreetingHostname
+	}
+	return s.hostname()
+}
+
+// Describe the session for handlers.
+func (s *session) metadata() Metadata {
+	return Metadata{
+		RemoteAddr: s.conn.RemoteAddr(),
+		LocalAddr:  s.conn.LocalAddr(),
+		RemoteName: s.remoteName,
+		AuthSender: s.authSender,
+		DSN:        s.dsn,
+		Limits:     s.getLimits(),
+		Context:    s.context(),
+		setLimits:  s.setLimits,
+	}
+}
+
+// Return the context passed to handlers, which includes the username once the client has authenticated.
+func (s *session) context() context.Context {
+	if s.authenticated {
+		return context.WithValue(s.ctx, authUsernameKey{}, s.authUsername)
+	}
+	return s.ctx
+}
+
+// Function called to handle connection requests.
+func (s *session) serve() {
+	defer atomic.AddInt32(&s.srv.openSessions, -1)
+	defer s.end()
+	defer s.conn.Close()
+	defer s.cancel()
+
+	if s.srv.Metrics != nil {
+		s.srv.Metrics.IncConnections()
+	}
+	s.endReason = ReasonError
+
+	// End the session if its context is cancelled, by closing the connection to interrupt any read or write.
+	conn := s.conn
+	go func() {
+		<-s.ctx.Done()
+		conn.Close()
+	}()
+
+	// Connections from a trusted proxy start with a PROXY protocol header, giving the address of the client.
+	// Headers from any other peer are not trusted, and are read as commands.
+	if s.srv.proxyAllowed(s.remoteIP) {
+		if err := s.readProxyHeader(); err != nil {
+			s.logf("Invalid PROXY protocol header from %s: %v", s.remoteIP, err)
+			return
+		}
+	}
+
+	// Refuse clients outside the allowed networks.
+	if !ipAllowed(net.ParseIP(s.remoteIP), s.srv.AllowedNets, s.srv.DeniedNets) {
+		s.reply("554 5.7.1", s.replies().AccessDenied)
+		return
+	}
+	if s.srv.ConnectHandler != nil {
+		if err := s.srv.ConnectHandler(s.metadata()); err != nil {
+			s.refuseConnection(err)
+			return
+		}
+	}
+
+	// Send banner.
+	s.reply("220", s.replies().Banner, s.greetingHostname(), s.appname())
+
+	// Record the TLS parameters if the connection was accepted by a TLS listener, as the handshake is now complete.
+	if s.listenerTLS != nil {
+		state := s.listenerTLS.ConnectionState()
+		s.tlsState = &state
+	}
+
+loop:
+	for {
+		// A failed write means the client has gone away, so stop rather than reading and handling more commands.
+		if s.writeErr != nil {
+			s.disconnected()
+			break
+		}
+
+		// Attempt to read a line from the socket.
+		// On timeout, send a timeout message and return from serve().
+		// On error, assume the client has gone away i.e. return from serve().
+		line, err := s.readLine()
+		if err == errLineTooLong {
+			s.reply("500 5.5.2", s.replies().LineTooLong)
+			continue
+		}
+		if err == errBareLF {
+			s.reply("500 5.5.2", s.replies().BareLF)
+			continue
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				s.writeTimeout()
+			} else {
+				s.disconnected()
+			}
+			break
+		}
+		if s.tooManyBytes() {
+			s.reply("552 5.3.4", s.replies().TooManyBytes)
+			break
+		}
+
+		// Recipients rejected by HandlerRcptBatch are only left out of the transaction for the DATA command.
+		if s.rcptErrs != nil {
+			s.to, s.toSent, s.dsn.Recipients = s.allTo, s.allToSent, s.allDSN
+			s.rcptErrs, s.allTo, s.allToSent, s.allDSN = nil, nil, nil, nil
 		}
 
 		verb, args := s.parseLine(line)
+		if s.srv.CommandObserver != nil {
+			s.srv.CommandObserver(s.metadata(), verb, args, verb == "AUTH")
+		}
+
+		// RFC 4954 section 4 allows AUTH commands of up to 12288 octets, which readLine permits.
+		if verb != "AUTH" && len(line)+2 > s.maxCommandLength() {
+			s.reply("500 5.5.2", s.replies().LineTooLong)
+			continue
+		}
+
+		if s.commandDisabled(verb) {
+			s.reply("502 5.5.1", s.replies().CommandDisabled)
+			continue
+		}
 
+		// Slow down clients sending commands faster than the CommandRateLimit, e.g. a flood of NOOP commands.
+		s.throttle()
+
+		// Disconnect clients which keep the session busy without sending messages.
+		// NOOP is not counted: like any command it restarts the Timeout, so clients can use it to keep the session
+		// open, limited by the CommandRateLimit and MaxSessionDuration.
 		switch verb {
-		case "HELO":
-			s.remoteName = args
-			s.writef("250 %s greets %s", s.srv.Hostname, s.remoteName)
+		case "RSET", "MAIL", "VRFY", "EXPN", "HELP":
+			s.idleCommands++
+			if s.srv.MaxIdleCommands > 0 && s.idleCommands > s.srv.MaxIdleCommands {
+				s.reply("421 4.7.0", s.replies().TooManyIdleCommands, s.hostname())
+				break loop
+			}
+		}
+
+		switch verb {
+		case "HELO", "EHLO", "LHLO":
+			// RFC 2033 section 4.1 replaces HELO and EHLO with LHLO, which is otherwise identical to EHLO.
+			if (verb == "LHLO") != s.srv.LMTP {
+				s.reply("500 5.5.2", s.replies().Unrecognized)
+				break
+			}
+			// RFC 2920 section 3.1 requires EHLO to be the last command in a group, and PIPELINING has not
+			// been offered before the first EHLO reply, so anything already received is not a legitimate client.
+			if s.srv.RejectEarlyPipelining && !s.greeted && s.br.Buffered() > 0 {
+				s.reply("554 5.7.1", s.replies().EarlyPipelining)
+				break loop
+			}
+			// RFC 5321 section 4.1.1.1 requires a domain or address literal, which may still be invalid, as
+			// many clients send a bare host name.
+			name, _ := parseHeloArg(args)
+			if name == "" {
+				s.reply("501 5.5.4", s.replies().HeloArgRequired, verb)
+				break
+			}
+			if s.srv.HeloChecker != nil {
+				if err := s.srv.HeloChecker(s.conn.RemoteAddr(), name, args); err != nil {
+					if s.writeHandlerError(err) {
+						break loop
+					}
+					break
+				}
+			}
+			s.remoteName = name
+			s.greeted = true
+			if verb == "HELO" {
+				s.reply("250", s.replies().Greeting, s.greetingHostname(), s.remoteName)
+			} else {
+				s.writef("%s", s.makeEHLOResponse())
+			}
 
 			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET, so reset for HELO too.
-			from = ""
-			gotFrom = false
-			to = nil
-			buffer.Reset()
-		case "EHLO":
-			s.remoteName = args
-			s.writef(s.makeEHLOResponse())
-
-			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET.
-			from = ""
-			gotFrom = false
-			to = nil
-			buffer.Reset()
+			s.reset()
 		case "MAIL":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
-				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+			if s.srv.tlsConfig() != nil && s.srv.TLSRequired && !s.tls {
+				s.reply("530 5.7.0", s.replies().TLSRequired)
 				break
 			}
 			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
-				s.writef("530 5.7.0 Authentication required")
+				s.reply("530 5.7.0", s.replies().AuthRequired)
+				break
+			}
+			// Once the server is shutting down, let the client know to reconnect elsewhere.
+			if atomic.LoadInt32(&s.srv.inShutdown) != 0 {
+				s.reply("421 4.3.2", s.replies().ShuttingDown)
+				s.endReason = ReasonShutdown
+				break loop
+			}
+			// A 421 reply closes the connection (RFC 5321 section 3.8), so the client can reconnect elsewhere.
+			if atomic.LoadInt32(&s.srv.draining) != 0 {
+				s.reply("421 4.3.2", s.replies().NotAccepting)
+				break loop
+			}
+			// RFC 6409 section 4.3 requires authentication for message submission.
+			if s.srv.Submission && !s.authenticated {
+				s.reply("530 5.7.0", s.replies().AuthRequired)
+				break
+			}
+			if s.srv.RequireHelo && !s.greeted {
+				s.reply("503 5.5.1", s.replies().HeloRequired)
 				break
 			}
 
-			match := mailFromRE.FindStringSubmatch(args)
-			if match == nil {
-				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid FROM parameter)")
-			} else {
-				// Validate the SIZE parameter if one was sent.
-				if len(match[2]) > 0 { // A parameter is present
-					sizeMatch := mailSizeRE.FindStringSubmatch(match[3])
-					if sizeMatch == nil {
-						s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
-					} else {
-						// Enforce the maximum message size if one is set.
-						size, err := strconv.Atoi(sizeMatch[1])
-						if err != nil { // Bad SIZE parameter
-							s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
-						} else if s.srv.MaxSize > 0 && size > s.srv.MaxSize { // SIZE above maximum size, if set
-							err = maxSizeExceeded(s.srv.MaxSize)
-							s.writef(err.Error())
-						} else { // SIZE ok
-							from = match[1]
-							gotFrom = true
-							s.writef("250 2.1.0 Ok")
-						}
+			s.reset()
+			// Delivery Status Notifications are sent with "MAIL FROM:<>".
+			from, paramArgs, ok := parsePath(args, "FROM:")
+			if !ok {
+				s.reply("501 5.5.4", s.replies().InvalidFrom)
+				break
+			}
+			if len(from)+2 > s.maxPathLength() {
+				s.reply("501 5.5.4", s.replies().PathTooLong)
+				break
+			}
+			params := parseParams(paramArgs)
+			if !s.paramsSupported(verb, params) {
+				s.reply("501 5.5.4", s.replies().UnsupportedParameter)
+				break
+			}
+
+			// Validate the SIZE parameter if one was sent.
+			if sizeParam, ok := params["SIZE"]; ok {
+				size, err := strconv.Atoi(sizeParam)
+				if err != nil || size < 0 { // Bad SIZE parameter
+					s.reply("501 5.5.4", s.replies().InvalidSize)
+					break
+				}
+				// Enforce the maximum message size if one is set.
+				if maxSize := s.maxSize(); maxSize > 0 && size > maxSize { // SIZE above maximum size, if set
+					err = maxSizeExceeded(maxSize)
+					s.writef(err.Error())
+					break
+				}
+			}
+
+			// Validate the AUTH parameter if one was sent and AUTH is supported (RFC 4954 section 5).
+			// The asserted mailbox is only passed on if the client is trusted, i.e. authenticated.
+			// Otherwise the server must behave as if "AUTH=<>" was sent.
+			if authParam, ok := params["AUTH"]; ok && s.srv.AuthHandler != nil {
+				mailbox, err := parseAuthParam(authParam)
+				if err != nil {
+					s.reply("501 5.5.4", s.replies().InvalidAuthParam)
+					break
+				}
+				if s.authenticated {
+					s.authSender = mailbox
+				}
+			}
+
+			// Validate the DSN parameters if any were sent (RFC 3461 section 4).
+			if retParam, ok := params["RET"]; ok {
+				ret := strings.ToUpper(retParam)
+				if ret != "FULL" && ret != "HDRS" {
+					s.reply("501 5.5.4", s.replies().InvalidRet)
+					break
+				}
+				s.dsn.Ret = ret
+			}
+			if envIDParam, ok := params["ENVID"]; ok {
+				envID, err := decodeXtext(envIDParam)
+				if err != nil || envID == "" || len(envIDParam) > 100 {
+					s.reply("501 5.5.4", s.replies().InvalidEnvID)
+					break
+				}
+				s.dsn.EnvID = envID
+			}
+
+			if containsDomain(s.srv.BlockedSenderDomains, addressDomain(from)) {
+				s.reply("550 5.1.0", s.replies().SenderRejected)
+				break
+			}
+			if s.srv.SenderChecker != nil {
+				if err := s.srv.SenderChecker(s.conn.RemoteAddr(), from); err != nil {
+					if s.writeHandlerError(err) {
+						break loop
 					}
-				} else { // No parameters after FROM
-					from = match[1]
-					gotFrom = true
-					s.writef("250 2.1.0 Ok")
+					break
 				}
 			}
-			to = nil
-			buffer.Reset()
+
+			s.from = from
+			s.gotFrom = true
+			s.params = params
+			s.reply("250 2.1.0", s.replies().SenderOk)
 		case "RCPT":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
-				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+			if s.srv.tlsConfig() != nil && s.srv.TLSRequired && !s.tls {
+				s.reply("530 5.7.0", s.replies().TLSRequired)
 				break
 			}
 			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
-				s.writef("530 5.7.0 Authentication required")
+				s.reply("530 5.7.0", s.replies().AuthRequired)
 				break
 			}
-			if !gotFrom {
-				s.writef("503 5.5.1 Bad sequence of commands (MAIL required before RCPT)")
+			if !s.gotFrom {
+				s.reply("503 5.5.1", s.replies().MailRequired)
 				break
 			}
+			// Disconnect clients probing for valid addresses, whose recipients are rejected rather than counted
+			// against MaxRecipients.
+			s.rcptCount++
+			if s.srv.MaxRcptAttempts > 0 && s.rcptCount > s.srv.MaxRcptAttempts {
+				s.reply("421 4.7.0", s.replies().TooManyRcptAttempts, s.hostname())
+				break loop
+			}
 
-			match := rcptToRE.FindStringSubmatch(args)
-			if match == nil {
-				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid TO parameter)")
-			} else {
-				// RFC 5321 specifies support for minimum of 100 recipients is required.
-				if s.srv.MaxRecipients == 0 {
-					s.srv.MaxRecipients = 100
+			to, paramArgs, ok := parsePath(args, "TO:")
+			if !ok || to == "" {
+				s.reply("501 5.5.4", s.replies().InvalidTo)
+				break
+			}
+			if len(to)+2 > s.maxPathLength() {
+				s.reply("501 5.5.4", s.replies().PathTooLong)
+				break
+			}
+			params := parseParams(paramArgs)
+			if !s.paramsSupported(verb, params) {
+				s.reply("501 5.5.4", s.replies().UnsupportedParameter)
+				break
+			}
+
+			// Validate the DSN parameters if any were sent (RFC 3461 section 4).
+			var dsnRcpt DSNRecipient
+			if notifyParam, ok := params["NOTIFY"]; ok {
+				notify, err := parseNotifyParam(notifyParam)
+				if err != nil {
+					s.reply("501 5.5.4", s.replies().InvalidNotify)
+					break
 				}
-				if len(to) == s.srv.MaxRecipients {
-					s.writef("452 4.5.3 Too many recipients")
-				} else {
-					accept := true
-					if s.srv.HandlerRcpt != nil {
-						accept = s.srv.HandlerRcpt(s.conn.RemoteAddr(), from, match[1])
+				dsnRcpt.Notify = notify
+			}
+			if orcptParam, ok := params["ORCPT"]; ok {
+				orcpt, err := parseORcptParam(orcptParam)
+				if err != nil {
+					s.reply("501 5.5.4", s.replies().InvalidORcpt)
+					break
+				}
+				dsnRcpt.ORcpt = orcpt
+			}
+
+			sent := to
+			if s.srv.RcptRewriter != nil {
+				var err error
+				if to, err = s.srv.RcptRewriter(to); err != nil {
+					if s.writeHandlerError(err) {
+						break loop
 					}
-					if accept {
-						to = append(to, match[1])
-						s.writef("250 2.1.5 Ok")
-					} else {
-						s.writef("550 5.1.0 Requested action not taken: mailbox unavailable")
+					break
+				}
+			}
+
+			// RFC 5321 section 4.5.1 requires the unqualified postmaster address to be accepted.
+			if len(s.srv.AllowedRecipientDomains) > 0 && !strings.EqualFold(to, "postmaster") &&
+				!containsDomain(s.srv.AllowedRecipientDomains, addressDomain(to)) {
+				s.reply("550 5.7.1", s.replies().RelayDenied)
+				break
+			}
+			if s.srv.RecipientMatcher != nil && !strings.EqualFold(to, "postmaster") && !s.srv.RecipientMatcher(to) {
+				s.reply("550 5.7.1", s.replies().RelayDenied)
+				break
+			}
+			// Prevent unauthenticated clients from relaying through the server to other domains.
+			if s.srv.LocalDomains != nil && !s.srv.AllowRelay && !s.authenticated && !strings.EqualFold(to, "postmaster") &&
+				!containsDomain(s.srv.LocalDomains, addressDomain(to)) {
+				s.reply("550 5.7.1", s.replies().RelayDenied)
+				break
+			}
+			if s.srv.RejectDuplicateRcpt && containsAddress(s.to, to) {
+				s.reply("553 5.1.1", s.replies().DuplicateRecipient)
+				break
+			}
+
+			if len(s.to) >= s.maxRecipients() {
+				s.reply("452 4.5.3", s.replies().TooManyRecipients)
+				break
+			}
+
+			if s.srv.HandlerRcptWithMetadata != nil {
+				if err := s.srv.HandlerRcptWithMetadata(s.metadata(), s.from, to); err != nil {
+					if s.writeHandlerError(err) {
+						break loop
 					}
+					break
 				}
+			} else if s.srv.HandlerRcptWithError != nil {
+				if err := s.srv.HandlerRcptWithError(s.conn.RemoteAddr(), s.from, to); err != nil {
+					if s.writeHandlerError(err) {
+						break loop
+					}
+					break
+				}
+			} else if s.srv.HandlerRcptWithParams != nil {
+				if !s.srv.HandlerRcptWithParams(s.conn.RemoteAddr(), s.from, to, params) {
+					s.reply(s.rcptRejectCode(), s.replies().MailboxUnavailable)
+					break
+				}
+			} else if s.srv.HandlerRcpt != nil && !s.srv.HandlerRcpt(s.conn.RemoteAddr(), s.from, to) {
+				s.reply(s.rcptRejectCode(), s.replies().MailboxUnavailable)
+				break
 			}
+			s.to = append(s.to, to)
+			s.toSent = append(s.toSent, sent)
+			s.dsn.Recipients = append(s.dsn.Recipients, dsnRcpt)
+			s.reply("250 2.1.5", s.replies().RecipientOk)
 		case "DATA":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
-				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+			if s.srv.tlsConfig() != nil && s.srv.TLSRequired && !s.tls {
+				s.reply("530 5.7.0", s.replies().TLSRequired)
 				break
 			}
 			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
-				s.writef("530 5.7.0 Authentication required")
+				s.reply("530 5.7.0", s.replies().AuthRequired)
 				break
 			}
-			if !gotFrom || len(to) == 0 {
-				s.writef("503 5.5.1 Bad sequence of commands (MAIL & RCPT required before DATA)")
+			if !s.gotFrom || (len(s.to) == 0 && !s.srv.AllowEmptyRecipients) {
+				s.reply("503 5.5.1", s.replies().RcptRequired)
 				break
 			}
+			// The envelope is kept after DATA fails, so the client may send DATA again without MAIL and RCPT,
+			// but nothing is kept from the data of the failed attempt.
+			s.buffer.Reset()
+			if s.srv.HandlerRcptBatch != nil {
+				if ok, closing := s.checkRcptBatch(); !ok {
+					if closing {
+						break loop
+					}
+					break
+				}
+			}
+			if s.srv.DataChecker != nil {
+				if err := s.srv.DataChecker(s.context(), s.from, s.to); err != nil {
+					if s.writeHandlerError(err) {
+						break loop
+					}
+					break
+				}
+			}
 
-			s.writef("354 Start mail input; end with <CR><LF>.<CR><LF>")
+			s.reply("354", s.replies().DataPrompt)
+
+			// Stream the message body to the reader handler or spill handler, if configured.
+			// Any data not read by the handler is discarded before replying.
+			// If the server is shutting down and its deadline passes, abort the transfer as for readData.
+			if s.srv.ReaderHandler != nil || s.srv.SpillHandler != nil {
+				abort := s.srv.getAbortContext()
+				stop := s.interruptReads(abort)
+				r := &dataReader{s: s}
+				var err error
+				if s.srv.ReaderHandler != nil {
+					body := io.MultiReader(bytes.NewReader(s.headers()), r)
+					err = s.srv.ReaderHandler(s.metadata(), s.from, s.to, body)
+				} else {
+					err = s.handleSpilled(r)
+				}
+				drainErr := r.drain()
+				stop()
+				if drainErr != nil {
+					if abort.Err() != nil {
+						s.reply("451 4.3.2", s.replies().Aborted)
+						s.endReason = ReasonShutdown
+					} else if drainErr == errTooManyBytes {
+						s.reply("552 5.3.4", s.replies().TooManyBytes)
+					} else if netErr, ok := drainErr.(net.Error); ok && netErr.Timeout() {
+						s.writeTimeout()
+					} else {
+						s.disconnected()
+					}
+					break loop
+				}
+				switch r.err.(type) {
+				case maxSizeExceededError, maxLinesExceededError, lineTooLongError, eightBitDataError, bareLineEndingError:
+					s.writeDataError(r.err)
+					continue
+				}
+				if err != nil {
+					if s.writeDataError(err) {
+						break loop
+					}
+					break
+				}
+				s.writeDataReplies(func(int) bool {
+					s.writeQueued("", r.size)
+					return false
+				})
+				if s.accepted() {
+					break loop
+				}
+				break
+			}
 
 			// Attempt to read message body from the socket.
 			// On timeout, send a timeout message and return from serve().
 			// On net.Error, assume the client has gone away i.e. return from serve().
 			// On other errors, allow the client to try again.
-			data, err := s.readData()
+			// If the server is shutting down and its deadline passes, abort the transfer and close the connection.
+			data, err := s.readData(s.srv.getAbortContext())
 			if err != nil {
+				if err == context.Canceled {
+					s.reply("451 4.3.2", s.replies().Aborted)
+					s.endReason = ReasonShutdown
+					break loop
+				}
+				if err == errTooManyBytes {
+					s.reply("552 5.3.4", s.replies().TooManyBytes)
+					break loop
+				}
 				switch err.(type) {
 				case net.Error:
 					if err.(net.Error).Timeout() {
-						s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
+						s.writeTimeout()
+					} else {
+						s.disconnected()
 					}
 					break loop
-				case maxSizeExceededError:
-					s.writef(err.Error())
+				case maxSizeExceededError, maxLinesExceededError, lineTooLongError, eightBitDataError, bareLineEndingError:
+					s.writeDataError(err)
+					continue
+				case headerRejectedError:
+					if s.writeDataError(err.(headerRejectedError).err) {
+						break loop
+					}
 					continue
 				default:
-					s.writef("451 4.3.0 Requested action aborted: local error in processing")
+					s.writeDataError(s.localError())
 					continue
 				}
 			}
 
 			// Create Received header & write message body into buffer.
-			buffer.Reset()
-			buffer.Write(s.makeHeaders(to))
-			buffer.Write(data)
+			s.buffer.Write(s.headers())
+			if s.srv.Submission {
+				s.buffer.Write(s.makeSubmissionHeaders(data))
+			}
+			s.buffer.Write(data)
 
-			// Pass mail on to handler.
-			if s.srv.Handler != nil {
-				err := s.srv.Handler(s.conn.RemoteAddr(), from, to, buffer.Bytes())
+			// Allow the message to be modified before it is handled, e.g. to add trace headers.
+			if s.srv.MessageModifier != nil {
+				modified, err := s.srv.MessageModifier(s.metadata(), s.buffer.Bytes())
 				if err != nil {
-					checkErrFormat := regexp.MustCompile(`^([2-5][0-9]{2})[\s\-](.+)$`)
-					if checkErrFormat.MatchString(err.Error()) {
-						s.writef(err.Error())
-					} else {
-						s.writef("451 4.3.5 Unable to process mail")
+					closing := s.writeDataError(err)
+					s.afterData(err)
+					if closing {
+						break loop
 					}
 					break
 				}
-				s.writef("250 2.0.0 Ok: queued")
-			} else if s.srv.MsgIDHandler != nil {
-				msgID, err := s.srv.MsgIDHandler(s.conn.RemoteAddr(), from, to, buffer.Bytes())
+				s.buffer.Reset()
+				s.buffer.Write(modified)
+			}
+
+			// Sign the message last, so the signature covers any modifications.
+			if s.srv.DKIMSigner != nil && s.authenticated {
+				signature, err := s.srv.DKIMSigner.Sign(s.buffer.Bytes())
 				if err != nil {
-					checkErrFormat := regexp.MustCompile(`^([2-5][0-9]{2})[\s\-](.+)$`)
-					if checkErrFormat.MatchString(err.Error()) {
-						s.writef(err.Error())
-					} else {
-						s.writef("451 4.3.5 Unable to process mail")
+					s.logf("DKIM signing failed: %v", err)
+					s.writeDataError(s.localError())
+					s.afterData(err)
+					break
+				}
+				signed := append(signature, s.buffer.Bytes()...)
+				s.buffer.Reset()
+				s.buffer.Write(signed)
+			}
+
+			// In LMTP mode, deliver to each recipient and report each result.
+			if s.srv.LMTP && s.srv.HandlerLMTP != nil {
+				errs := s.handleLMTP(s.envelope())
+				var firstErr error
+				accepted := false
+				s.writeDataReplies(func(i int) bool {
+					err := errs[i]
+					if err == nil {
+						s.writeQueued("", len(data))
+						accepted = true
+						return false
+					}
+					if firstErr == nil {
+						firstErr = err
 					}
+					s.writeHandlerError(err)
+					return false
+				})
+				if !accepted {
+					s.afterData(firstErr)
+					s.reset()
 					break
 				}
+				s.afterData(nil)
+				if s.accepted() {
+					break loop
+				}
+				break
+			}
 
-				if msgID != "" {
-					s.writef("250 2.0.0 Ok: queued as " + msgID)
-				} else {
-					s.writef("250 2.0.0 Ok: queued")
+			// Pass mail on to handler.
+			var msgID string
+			msgID, err = s.handle(s.envelope())
+			if err != nil {
+				closing := s.writeDataError(err)
+				s.afterData(err)
+				if closing {
+					break loop
 				}
-			} else {
-				s.writef("250 2.0.0 Ok: queued")
+				break
 			}
 
+			s.writeDataReplies(func(int) bool {
+				s.writeQueued(msgID, len(data))
+				return false
+			})
+			s.afterData(nil)
+
 			// Reset for next mail.
-			from = ""
-			gotFrom = false
-			to = nil
-			buffer.Reset()
+			if s.accepted() {
+				break loop
+			}
 		case "QUIT":
-			s.writef("221 2.0.0 %s %s ESMTP Service closing transmission channel", s.srv.Hostname, s.srv.Appname)
+			s.reply("221 2.0.0", s.replies().Quit, s.hostname(), s.appname())
+			s.endReason = ReasonQuit
 			break loop
 		case "RSET":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
-				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+			if s.srv.tlsConfig() != nil && s.srv.TLSRequired && !s.tls {
+				s.reply("530 5.7.0", s.replies().TLSRequired)
 				break
 			}
-			s.writef("250 2.0.0 Ok")
-			from = ""
-			gotFrom = false
-			to = nil
-			buffer.Reset()
+			s.reply("250 2.0.0", s.replies().Ok)
+			s.reset()
 		case "NOOP":
-			s.writef("250 2.0.0 Ok")
+			s.reply("250 2.0.0", s.replies().Ok)
 		case "XCLIENT":
 			s.xClient = args
 			if s.xClientTrust {
@@ -566,244 +2357,1357 @@ loop:
 						}
 					}
 				}
-				if len(s.xClientADDR) > 7 {
-					s.remoteIP = s.xClientADDR
-					if len(s.xClientNAME) > 4 {
-						s.remoteHost = s.xClientNAME
-					} else {
-						names, err := net.LookupAddr(s.remoteIP)
-						if err == nil && len(names) > 0 {
-							s.remoteHost = names[0]
-						} else {
-							s.remoteHost = "unknown"
-						}
-					}
+				if len(s.xClientADDR) > 7 {
+					s.remoteIP = s.xClientADDR
+					if len(s.xClientNAME) > 4 {
+						s.remoteHost = s.xClientNAME
+					} else {
+						s.remoteHost = s.srv.lookupHost(s.remoteIP)
+					}
+				}
+			}
+			s.reply("250 2.0.0", s.replies().Ok)
+		case "HELP":
+			text := s.srv.HelpMessage
+			if s.srv.HelpHandler != nil {
+				var err error
+				if text, err = s.srv.HelpHandler(args); err != nil {
+					if s.writeHandlerError(err) {
+						break loop
+					}
+					break
+				}
+			} else if text == "" {
+				s.reply("502 5.5.1", s.replies().NotImplemented)
+				break
+			}
+
+			// Send each line of the help text in a multiline reply.
+			lines := strings.Split(strings.TrimRight(text, "\r\n"), "\n")
+			for i, line := range lines {
+				lines[i] = "2.0.0 " + strings.TrimRight(line, "\r")
+			}
+			s.writeMultiline("214", lines)
+		case "ATRN":
+			if s.srv.HandlerAtrn == nil {
+				s.reply("502 5.5.1", s.replies().NotImplemented)
+				break
+			}
+			if s.srv.tlsConfig() != nil && s.srv.TLSRequired && !s.tls {
+				s.reply("530 5.7.0", s.replies().TLSRequired)
+				break
+			}
+			// RFC 2645 section 5 requires authentication, as the client receives mail for its domains.
+			if !s.authenticated {
+				s.reply("530 5.7.0", s.replies().AuthRequired)
+				break
+			}
+			if s.gotFrom {
+				s.reply("503 5.5.1", s.replies().AtrnInTransaction)
+				break
+			}
+			var domains []string
+			for _, domain := range strings.Split(args, ",") {
+				if domain = strings.TrimSpace(domain); domain != "" {
+					domains = append(domains, domain)
+				}
+			}
+
+			// Hand the connection over, including anything already buffered from the client.
+			s.reply("250 2.0.0", s.replies().AtrnStarted)
+			s.flush()
+			conn := &bufferedConn{Conn: s.conn, r: s.br}
+			if err := s.srv.HandlerAtrn(s.metadata(), domains, conn); err != nil {
+				s.logf("ATRN handler failed: %v", err)
+			}
+			s.endReason = ReasonQuit
+			break loop
+		case "ETRN":
+			if s.srv.HandlerEtrn == nil {
+				s.reply("502 5.5.1", s.replies().NotImplemented)
+				break
+			}
+			if s.srv.tlsConfig() != nil && s.srv.TLSRequired && !s.tls {
+				s.reply("530 5.7.0", s.replies().TLSRequired)
+				break
+			}
+			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+				s.reply("530 5.7.0", s.replies().AuthRequired)
+				break
+			}
+			// RFC 1985 section 5 does not permit ETRN during mail transactions.
+			if s.gotFrom {
+				s.reply("503 5.5.1", s.replies().EtrnInTransaction)
+				break
+			}
+			if args == "" {
+				s.reply("501 5.5.4", s.replies().EtrnArgRequired)
+				break
+			}
+			if err := s.srv.HandlerEtrn(s.metadata(), args); err != nil {
+				var smtpErr *Error
+				if !errors.As(err, &smtpErr) {
+					s.reply("458 4.3.0", s.replies().EtrnFailed, args)
+					break
+				}
+				if s.writeHandlerError(err) {
+					break loop
 				}
+				break
 			}
-			s.writef("250 2.0.0 Ok")
-		case "HELP", "VRFY", "EXPN":
+			s.reply("250 2.0.0", s.replies().EtrnStarted, args)
+		case "VRFY", "EXPN":
 			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
-			s.writef("502 5.5.1 Command not implemented")
+			s.reply("502 5.5.1", s.replies().NotImplemented)
 		case "STARTTLS":
 			// Parameters are not allowed (RFC 3207 section 4).
 			if args != "" {
-				s.writef("501 5.5.2 Syntax error (no parameters allowed)")
+				s.reply("501 5.5.2", s.replies().NoParameters)
 				break
 			}
 
 			// Handle case where TLS is requested but not configured (and therefore not listed as a service extension).
-			if s.srv.TLSConfig == nil {
-				s.writef("502 5.5.1 Command not implemented")
+			if s.srv.tlsConfig() == nil {
+				s.reply("502 5.5.1", s.replies().NotImplemented)
 				break
 			}
 
 			// Handle case where STARTTLS is received when TLS is already in use.
 			if s.tls {
-				s.writef("503 5.5.1 Bad sequence of commands (TLS already in use)")
+				s.reply("503 5.5.1", s.replies().TLSInUse)
 				break
 			}
 
-			s.writef("220 2.0.0 Ready to start TLS")
+			s.reply("220 2.0.0", s.replies().StartTLS)
 
-			// Establish a TLS connection with the client.
-			tlsConn := tls.Server(s.conn, s.srv.TLSConfig)
+			// Establish a TLS connection with the client, within the timeout so a stalled client cannot hold the session.
+			if timeout := s.tlsHandshakeTimeout(); timeout > 0 {
+				s.conn.SetDeadline(time.Now().Add(timeout))
+			}
+			tlsConn := tls.Server(s.conn, s.srv.tlsConfig())
 			err := tlsConn.Handshake()
+			s.conn.SetDeadline(time.Time{})
 			if err != nil {
-				s.writef("403 4.7.0 TLS handshake failed")
+				s.logf("TLS handshake with %s failed: %v", s.remoteIP, err)
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					s.reply("403 4.7.0", s.replies().TLSTimeout)
+					break loop
+				}
+				s.reply("403 4.7.0", s.replies().TLSFailed)
 				break
 			}
 
 			// TLS handshake succeeded, switch to using the TLS connection.
-			s.conn = tlsConn
-			s.br = bufio.NewReader(s.conn)
-			s.bw = bufio.NewWriter(s.conn)
+			// Replacing the reader discards any plaintext sent after STARTTLS, so commands injected before the
+			// handshake are never run as if they had been sent over TLS (CVE-2011-0411).
+			s.setConn(tlsConn)
 			s.tls = true
+			if s.srv.Metrics != nil {
+				s.srv.Metrics.IncTLSUpgrades()
+			}
+			state := tlsConn.ConnectionState()
+			s.tlsState = &state
 
 			// RFC 3207 specifies that the server must discard any prior knowledge obtained from the client.
 			s.remoteName = ""
-			from = ""
-			gotFrom = false
-			to = nil
-			buffer.Reset()
+			s.greeted = false
+			s.reset()
 		case "AUTH":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
-				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+			if s.srv.tlsConfig() != nil && s.srv.TLSRequired && !s.tls {
+				s.reply("530 5.7.0", s.replies().TLSRequired)
 				break
 			}
 			// Handle case where AUTH is requested but not configured (and therefore not listed as a service extension).
-			if s.srv.AuthHandler == nil {
-				s.writef("502 5.5.1 Command not implemented")
+			// EXTERNAL relies on the client certificate alone, so it is available without an AuthHandler.
+			if s.srv.AuthHandler == nil && s.certIdentity() == "" {
+				s.reply("502 5.5.1", s.replies().NotImplemented)
 				break
 			}
 
+			// Refuse clients which have failed to authenticate too often.
+			if s.authLockedOut() {
+				s.reply("421 4.7.0", s.replies().TooManyAuthFailures)
+				break loop
+			}
+
 			// Handle case where AUTH is received when already authenticated.
 			if s.authenticated {
-				s.writef("503 5.5.1 Bad sequence of commands (already authenticated for this session)")
+				s.reply("503 5.5.1", s.replies().AlreadyAuthenticated)
 				break
 			}
 
 			// RFC 4954 specifies that AUTH is not permitted during mail transactions.
-			if gotFrom || len(to) > 0 {
-				s.writef("503 5.5.1 Bad sequence of commands (AUTH not permitted during mail transaction)")
+			if s.gotFrom || len(s.to) > 0 {
+				s.reply("503 5.5.1", s.replies().AuthInTransaction)
 				break
 			}
 
 			// RFC 4954 requires a mechanism parameter.
 			authType, authArgs := s.parseLine(args)
 			if authType == "" {
-				s.writef("501 5.5.4 Malformed AUTH input (argument required)")
+				s.reply("501 5.5.4", s.replies().AuthArgRequired)
+				break
+			}
+
+			// RFC 4954 requires rejecting unsupported authentication mechanisms with a 504 response.
+			allowedAuth := s.usableAuthMechs()
+			if allowed, found := allowedAuth[authType]; !found || !allowed {
+				s.reply("504 5.5.4", s.replies().AuthMechUnrecognized)
+				break
+			}
+
+			// RFC 4954 also specifies that ESMTP code 5.5.4 ("Invalid command arguments") should be returned
+			// when attempting to use an unsupported authentication type.
+			// Many servers return 5.7.4 ("Security features not supported") instead.
+			switch authType {
+			case "PLAIN":
+				s.authenticated, err = s.handleAuthPlain(authArgs)
+			case "LOGIN":
+				s.authenticated, err = s.handleAuthLogin(authArgs)
+			case "CRAM-MD5":
+				s.authenticated, err = s.handleAuthCramMD5()
+			case "EXTERNAL":
+				s.authenticated, err = s.handleAuthExternal(authArgs)
+			}
+
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					s.writeTimeout()
+					break loop
+				}
+
+				s.writef(err.Error())
 				break
 			}
-
-			// RFC 4954 requires rejecting unsupported authentication mechanisms with a 504 response.
-			allowedAuth := s.authMechs()
-			if allowed, found := allowedAuth[authType]; !found || !allowed {
-				s.writef("504 5.5.4 Unrecognized authentication type")
-				break
+
+			if s.authenticated {
+				s.reply("235 2.7.0", s.replies().AuthSuccessful)
+			} else {
+				if s.srv.Metrics != nil {
+					s.srv.Metrics.IncAuthFailures()
+				}
+				if s.authFailed() {
+					s.reply("421 4.7.0", s.replies().TooManyAuthFailures)
+					break loop
+				}
+				s.reply("535 5.7.8", s.replies().AuthInvalid)
+			}
+		default:
+			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
+			s.reply("500 5.5.2", s.replies().Unrecognized)
+		}
+	}
+}
+
+// Wait until the next command is due by the CommandRateLimit, unless the server is shutting down. A client may send a
+// burst of as many commands as the limit, after which they are spaced out evenly.
+func (s *session) throttle() {
+	if s.srv.CommandRateLimit <= 0 {
+		return
+	}
+	now := time.Now()
+	if earliest := now.Add(-time.Second); s.commandTime.Before(earliest) {
+		s.commandTime = earliest
+	}
+	s.commandTime = s.commandTime.Add(time.Second / time.Duration(s.srv.CommandRateLimit))
+	wait := s.commandTime.Sub(now)
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.srv.getShutdownChan():
+	case <-s.ctx.Done():
+	}
+}
+
+// Record that a message has been accepted, and reset for the next one. Once MaxTransactions messages have been
+// accepted, the client is told the connection is closing, and true is returned.
+func (s *session) accepted() bool {
+	s.transactions++
+	s.idleCommands = 0
+	if s.srv.Metrics != nil {
+		s.srv.Metrics.IncMessages()
+	}
+	s.reset()
+	if s.srv.MaxTransactions > 0 && s.transactions >= s.srv.MaxTransactions {
+		s.reply("421 4.7.0", s.replies().TooManyTransactions, s.hostname())
+		return true
+	}
+	return false
+}
+
+// Report whether the client has reached AuthMaxFailures.
+func (s *session) authLockedOut() bool {
+	return s.srv.AuthMaxFailures > 0 && s.srv.authFailures.count(s.remoteIP, s.srv.currentTime()) >= s.srv.AuthMaxFailures
+}
+
+// Record a failed authentication, then wait for the AuthFailureDelay unless the server is shutting down.
+// Returns true if the client has now reached AuthMaxFailures, without waiting.
+func (s *session) authFailed() bool {
+	if s.srv.AuthMaxFailures > 0 && s.srv.authFailures.add(s.remoteIP, s.srv.currentTime()) >= s.srv.AuthMaxFailures {
+		return true
+	}
+	if s.srv.AuthFailureDelay > 0 {
+		timer := time.NewTimer(s.srv.AuthFailureDelay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-s.srv.getShutdownChan():
+		case <-s.ctx.Done():
+		}
+	}
+	return false
+}
+
+// Wrapper function for writing a complete line to the socket.
+func (s *session) writef(format string, args ...interface{}) error {
+	if s.srv.Timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.srv.Timeout))
+	}
+
+	line := fmt.Sprintf(format, args...)
+	if s.srv.DisableEnhancedStatusCodes {
+		line = stripEnhancedCodes(line)
+	}
+	if s.srv.ReplyObserver != nil {
+		s.srv.ReplyObserver(s.metadata(), line)
+	}
+	if s.srv.Trace != nil {
+		for _, l := range strings.Split(line, "\r\n") {
+			s.srv.Trace(s.id, DirectionOut, l)
+		}
+	}
+	fmt.Fprint(s.bw, line+"\r\n")
+	var err error
+	if !s.deferFlush(line) {
+		err = s.flush()
+	}
+
+	if Debug {
+		verb := "WROTE"
+		if s.srv.LogWrite != nil {
+			s.srv.LogWrite(s.remoteIP, verb, line)
+		} else {
+			log.Println(s.id, s.remoteIP, verb, line)
+		}
+	}
+
+	return err
+}
+
+// Send any buffered replies to the client.
+func (s *session) flush() error {
+	err := s.bw.Flush()
+	if err != nil && s.writeErr == nil {
+		s.writeErr = err
+	}
+	return err
+}
+
+// Report whether sending a reply can be deferred with FlushCoalesced. RFC 2920 section 3.1 allows replies to be held
+// while the client has sent further commands. Replies which change the state of the connection, prompt the client
+// for input, or report errors are always sent immediately.
+func (s *session) deferFlush(line string) bool {
+	if s.srv.FlushStrategy != FlushCoalesced || line[0] != '2' || strings.HasPrefix(line, "220") ||
+		strings.HasPrefix(line, "221") {
+		return false
+	}
+	return s.hasBufferedLine()
+}
+
+// Report whether a complete line from the client has been buffered, so it can be read without waiting.
+func (s *session) hasBufferedLine() bool {
+	pending, _ := s.br.Peek(s.br.Buffered())
+	return bytes.IndexByte(pending, '\n') >= 0
+}
+
+// Tell the client a message of size bytes has been accepted, with the message ID if the handler returned one.
+func (s *session) writeQueued(msgID string, size int) error {
+	text := formatReply(s.replies().Queued)
+	if msgID != "" {
+		text = formatReply(s.replies().QueuedAs, msgID)
+	}
+	if s.srv.ReportMessageSize {
+		text += fmt.Sprintf(" (%d bytes)", size)
+	}
+	return s.writef("250 2.0.0 %s", text)
+}
+
+// Record that the session ended as the connection failed, because the client went away or the server closed it
+// while shutting down.
+func (s *session) disconnected() {
+	s.endReason = ReasonClientDisconnect
+	if atomic.LoadInt32(&s.srv.inShutdown) != 0 {
+		s.endReason = ReasonShutdown
+	}
+}
+
+// Tell the client the connection is being closed because a read or write timed out, or the session has lasted
+// MaxSessionDuration. The text can be overridden with Replies.Timeout, but the 421 code is fixed as clients rely on it.
+func (s *session) writeTimeout() error {
+	s.endReason = ReasonTimeout
+	if !s.deadline.IsZero() && !time.Now().Before(s.deadline) {
+		return s.reply("421 4.4.2", s.replies().SessionExpired, s.hostname())
+	}
+	return s.reply("421 4.4.2", s.replies().Timeout, s.hostname(), s.appname())
+}
+
+// Set the deadline for the next read from the client: Timeout from now, or the end of the session if sooner.
+func (s *session) setReadDeadline() {
+	deadline := s.deadline
+	if s.srv.Timeout > 0 {
+		if t := time.Now().Add(s.srv.Timeout); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	if !deadline.IsZero() {
+		s.conn.SetReadDeadline(deadline)
+	}
+}
+
+// Matches the reply code and enhanced status code at the start of a reply line, e.g. "250 2.0.0 ".
+var enhancedCodeRegexp = regexp.MustCompile(`^([2-5][0-9]{2}[ -])[245]\.[0-9]{1,3}\.[0-9]{1,3}(?: |$)`)
+
+// Remove the enhanced status code from each line of a reply, keeping the reply code, for DisableEnhancedStatusCodes.
+func stripEnhancedCodes(reply string) string {
+	lines := strings.Split(reply, "\r\n")
+	for i, line := range lines {
+		if enhancedCodeRegexp.MatchString(line) {
+			lines[i] = strings.TrimRight(enhancedCodeRegexp.ReplaceAllString(line, "$1"), " ")
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// Send a multiline reply, with the reply code on every line (RFC 5321 section 4.2.1).
+func (s *session) writeMultiline(code string, lines []string) error {
+	return s.writef("%s", formatMultiline(code, lines))
+}
+
+// Format a multiline reply. Every line except the last has a hyphen following the reply code.
+func formatMultiline(code string, lines []string) string {
+	var b strings.Builder
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(code + sep + line)
+	}
+	return b.String()
+}
+
+// Reply to the client with an error returned by a handler.
+// Errors formatted as SMTP replies are sent as is, anything else results in a generic local error.
+// Returns true if the reply closes the connection.
+func (s *session) writeHandlerError(err error) bool {
+	var smtpErr *Error
+	if errors.As(err, &smtpErr) {
+		// Only transient and permanent failures may be sent, so the client does not take the error for success.
+		if smtpErr.Code < 400 || smtpErr.Code > 599 {
+			s.logf("Handler returned an error with invalid reply code %d", smtpErr.Code)
+			s.reply("451 4.3.5", s.replies().ProcessingError)
+			return false
+		}
+		// A message with several lines is sent as a multiline reply, with the enhanced status code on every line.
+		lines := strings.Split(strings.TrimRight(smtpErr.Message, "\r\n"), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(line, "\r")
+			if smtpErr.EnhancedCode != "" {
+				lines[i] = smtpErr.EnhancedCode + " " + lines[i]
+			}
+		}
+		s.writeMultiline(strconv.Itoa(smtpErr.Code), lines)
+		return smtpErr.Code == 421
+	}
+
+	checkErrFormat := regexp.MustCompile(`^([2-5][0-9]{2})[\s\-](.+)$`)
+	if checkErrFormat.MatchString(err.Error()) {
+		s.writef(err.Error())
+		return strings.HasPrefix(err.Error(), "421")
+	}
+	s.reply("451 4.3.5", s.replies().ProcessingError)
+	return false
+}
+
+// Write a reply made up of a reply code (and enhanced status code, if any) followed by the reply text.
+func (s *session) reply(code string, text string, args ...interface{}) error {
+	return s.writef("%s %s", code, formatReply(text, args...))
+}
+
+// Return the reply texts for the session, with defaults for any not configured.
+func (s *session) replies() *Replies {
+	if s.replyTexts == nil {
+		s.replyTexts = s.srv.Replies.withDefaults()
+		if s.srv.HideSoftwareVersion {
+			// Drop the Appname argument, and the space before it, from the texts which take it.
+			for _, text := range []*string{&s.replyTexts.Banner, &s.replyTexts.Quit, &s.replyTexts.Timeout} {
+				*text = strings.Replace(*text, " %[2]s", "", 1)
+			}
+		}
+	}
+	return s.replyTexts
+}
+
+// Return the application name for replies, or an empty string if HideSoftwareVersion is set.
+func (s *session) appname() string {
+	if s.srv.HideSoftwareVersion {
+		return ""
+	}
+	return s.srv.Appname
+}
+
+// Maximum length of AUTH commands and responses, including the CRLF (RFC 4954 section 4).
+const authLineLength = 12288
+
+// Returned by readLine when a line is too long. The line is discarded, so the session can continue.
+// It is formatted as a reply, as errors during authentication exchanges are sent to the client as is.
+var errLineTooLong = errors.New("500 5.5.2 Line too long")
+
+// Returned by readLine when a line ends in a bare LF and RequireCRLF is set. It is formatted as a reply, as for
+// errLineTooLong.
+var errBareLF = errors.New("500 5.5.2 Line must end with CRLF")
+
+// Read a complete line from the socket.
+// Lines are limited to the maximum command length, or the longer AUTH line length.
+func (s *session) readLine() (string, error) {
+	s.setReadDeadline()
+	// Send any replies held by FlushCoalesced before waiting for the client.
+	if s.srv.FlushStrategy == FlushCoalesced && s.bw.Buffered() > 0 && !s.hasBufferedLine() {
+		s.flush()
+	}
+
+	limit := s.maxCommandLength()
+	if limit < authLineLength {
+		limit = authLineLength
+	}
+	raw, err := readLimitedLine(s.br, limit)
+	if err != nil {
+		return "", err
+	}
+	if s.srv.Trace != nil {
+		s.srv.Trace(s.id, DirectionIn, strings.TrimRight(string(raw), "\r\n"))
+	}
+	// Strip the line ending only, keeping the rest of the line as sent. RFC 5321 section 2.3.8 requires CRLF, but a
+	// bare LF is accepted unless RequireCRLF is set.
+	line := strings.TrimSuffix(string(raw), "\n")
+	crlf := strings.HasSuffix(line, "\r")
+	line = strings.TrimSuffix(line, "\r")
+
+	if Debug {
+		verb := "READ"
+		if s.srv.LogRead != nil {
+			s.srv.LogRead(s.remoteIP, verb, line)
+		} else {
+			log.Println(s.id, s.remoteIP, verb, line)
+		}
+	}
+
+	if !crlf && s.srv.RequireCRLF {
+		return "", errBareLF
+	}
+	return line, nil
+}
+
+// Read a line of up to limit bytes, including the line feed, without buffering more than that.
+// The remainder of a longer line is read and discarded, and errLineTooLong returned.
+func readLimitedLine(br *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > limit {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tooLong {
+			return nil, errLineTooLong
+		}
+		return line, nil
+	}
+}
+
+// Parse a line read from the socket.
+func (s *session) parseLine(line string) (verb string, args string) {
+	if idx := strings.Index(line, " "); idx != -1 {
+		verb = strings.ToUpper(line[:idx])
+		args = strings.TrimSpace(line[idx+1:])
+	} else {
+		verb = strings.ToUpper(line)
+		args = ""
+	}
+	return verb, args
+}
+
+// Parse the argument of HELO or EHLO into the domain or address literal identifying the client, ignoring any
+// further tokens. Reports whether the identity is syntactically valid (RFC 5321 section 4.1.1.1).
+func parseHeloArg(args string) (name string, ok bool) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return "", false
+	}
+	name = fields[0]
+	if strings.HasPrefix(name, "[") {
+		return name, parseAddressLiteral(name) != nil
+	}
+	return name, isDomain(name)
+}
+
+// Parse an address literal (RFC 5321 section 4.1.3), e.g. "[192.0.2.1]" or "[IPv6:2001:db8::1]".
+// Returns nil if it is not a valid IPv4 or IPv6 address literal.
+func parseAddressLiteral(literal string) net.IP {
+	if len(literal) < 2 || literal[0] != '[' || literal[len(literal)-1] != ']' {
+		return nil
+	}
+	addr := literal[1 : len(literal)-1]
+	if len(addr) > 5 && strings.EqualFold(addr[:5], "IPv6:") {
+		if ip := net.ParseIP(addr[5:]); ip != nil && strings.Contains(addr[5:], ":") {
+			return ip
+		}
+		return nil
+	}
+	if ip := net.ParseIP(addr); ip != nil && !strings.Contains(addr, ":") {
+		return ip
+	}
+	return nil
+}
+
+// Format an IP address as an address literal without the brackets, with the "IPv6:" tag for IPv6 addresses.
+func addressLiteral(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "IPv6:" + ip
+	}
+	return ip
+}
+
+// Report whether name is a syntactically valid domain (RFC 5321 section 4.1.2).
+func isDomain(name string) bool {
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ParseAddress parses the reverse-path or forward-path argument of a MAIL or RCPT command, following the "FROM:" or
+// "TO:", into the address and the ESMTP parameters after it (RFC 5321 section 4.1.2).
+// Source routes are removed, as RFC 5321 appendix C specifies they must be accepted but ignored.
+// Quoted local parts may contain spaces and angle brackets, and are returned with their quotes.
+// The null reverse-path "<>" results in an empty address.
+func ParseAddress(arg string) (addr string, params string, err error) {
+	if !strings.HasPrefix(arg, "<") {
+		return "", "", errors.New("address not enclosed in angle brackets")
+	}
+
+	// Find the closing angle bracket, skipping over quoted strings.
+	end := -1
+	quoted := false
+scan:
+	for i := 1; i < len(arg); i++ {
+		switch c := arg[i]; {
+		case quoted && c == '\\':
+			i++ // Skip the escaped character.
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+			// Anything else is allowed within a quoted string.
+		case c == '>':
+			end = i
+			break scan
+		case c == '<' || c == ' ' || c == '\t':
+			return "", "", errors.New("invalid character in address")
+		}
+	}
+	if end == -1 {
+		return "", "", errors.New("unterminated address")
+	}
+	addr, params = arg[1:end], arg[end+1:]
+	if params != "" && params[0] != ' ' {
+		return "", "", errors.New("missing space before parameters")
+	}
+
+	// Remove any source route, e.g. "@a.example,@b.example:".
+	if strings.HasPrefix(addr, "@") {
+		idx := strings.Index(addr, ":")
+		if idx == -1 {
+			return "", "", errors.New("invalid source route")
+		}
+		addr = addr[idx+1:]
+	}
+
+	return addr, strings.TrimSpace(params), nil
+}
+
+// Parse the argument of a MAIL or RCPT command, which starts with the keyword "FROM:" or "TO:".
+// Whitespace after the colon is tolerated, as some clients send it.
+func parsePath(args string, keyword string) (addr string, params string, ok bool) {
+	if len(args) < len(keyword) || !strings.EqualFold(args[:len(keyword)], keyword) {
+		return "", "", false
+	}
+	arg := strings.TrimLeft(args[len(keyword):], " \t")
+	addr, params, err := ParseAddress(arg)
+	return addr, params, err == nil
+}
+
+// Report whether the server supports all the parameters of a MAIL or RCPT command. Unless StrictParameters is set,
+// unrecognized parameters are ignored.
+func (s *session) paramsSupported(verb string, params map[string]string) bool {
+	if !s.srv.StrictParameters {
+		return true
+	}
+	for keyword := range params {
+		switch {
+		case verb == "MAIL" && (keyword == "SIZE" || keyword == "BODY" || keyword == "RET" || keyword == "ENVID"):
+		case verb == "MAIL" && keyword == "AUTH" && s.srv.AuthHandler != nil:
+		case verb == "RCPT" && (keyword == "NOTIFY" || keyword == "ORCPT"):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Parse the ESMTP parameters following the address in a MAIL or RCPT command.
+// Keywords are returned in upper case. Keywords without a value map to an empty string.
+func parseParams(args string) map[string]string {
+	params := make(map[string]string)
+	for _, param := range strings.Fields(args) {
+		keyword, value := param, ""
+		if idx := strings.Index(param, "="); idx != -1 {
+			keyword, value = param[:idx], param[idx+1:]
+		}
+		params[strings.ToUpper(keyword)] = value
+	}
+	return params
+}
+
+// Decode an xtext encoded string as defined in RFC 3461 section 4.
+func decodeXtext(xtext string) (string, error) {
+	var decoded strings.Builder
+	for i := 0; i < len(xtext); i++ {
+		c := xtext[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(xtext) {
+				return "", errors.New("truncated xtext hexchar")
+			}
+			hex := xtext[i+1 : i+3]
+			if strings.ToUpper(hex) != hex {
+				return "", errors.New("invalid xtext hexchar")
+			}
+			b, err := strconv.ParseUint(hex, 16, 8)
+			if err != nil {
+				return "", errors.New("invalid xtext hexchar")
 			}
+			decoded.WriteByte(byte(b))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", errors.New("invalid xtext character")
+		default:
+			decoded.WriteByte(c)
+		}
+	}
+	return decoded.String(), nil
+}
 
-			// RFC 4954 also specifies that ESMTP code 5.5.4 ("Invalid command arguments") should be returned
-			// when attempting to use an unsupported authentication type.
-			// Many servers return 5.7.4 ("Security features not supported") instead.
-			switch authType {
-			case "PLAIN":
-				s.authenticated, err = s.handleAuthPlain(authArgs)
-			case "LOGIN":
-				s.authenticated, err = s.handleAuthLogin(authArgs)
-			case "CRAM-MD5":
-				s.authenticated, err = s.handleAuthCramMD5()
-			}
+// Parse the value of a MAIL AUTH parameter (RFC 4954 section 5).
+// Returns the decoded mailbox, or an empty string for "<>".
+func parseAuthParam(value string) (string, error) {
+	mailbox, err := decodeXtext(value)
+	if err != nil {
+		return "", err
+	}
 
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
-					break loop
-				}
+	// Tolerate a mailbox enclosed in angle brackets.
+	if strings.HasPrefix(mailbox, "<") && strings.HasSuffix(mailbox, ">") {
+		mailbox = mailbox[1 : len(mailbox)-1]
+		if mailbox == "" {
+			return "", nil
+		}
+	}
 
-				s.writef(err.Error())
-				break
-			}
+	at := strings.LastIndex(mailbox, "@")
+	if at < 1 || at == len(mailbox)-1 || strings.ContainsAny(mailbox, "<> ") {
+		return "", errors.New("invalid AUTH mailbox")
+	}
+	return mailbox, nil
+}
 
-			if s.authenticated {
-				s.writef("235 2.7.0 Authentication successful")
-			} else {
-				s.writef("535 5.7.8 Authentication credentials invalid")
-			}
+// Parse the value of a RCPT NOTIFY parameter (RFC 3461 section 4.1).
+func parseNotifyParam(value string) ([]string, error) {
+	var notify []string
+	seen := make(map[string]bool)
+	for _, keyword := range strings.Split(strings.ToUpper(value), ",") {
+		switch keyword {
+		case "NEVER", "SUCCESS", "FAILURE", "DELAY":
 		default:
-			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
-			s.writef("500 5.5.2 Syntax error, command unrecognized")
+			return nil, errors.New("invalid NOTIFY keyword")
 		}
+		if seen[keyword] {
+			return nil, errors.New("duplicate NOTIFY keyword")
+		}
+		seen[keyword] = true
+		notify = append(notify, keyword)
+	}
+
+	// NEVER must not be combined with any other keyword.
+	if seen["NEVER"] && len(notify) > 1 {
+		return nil, errors.New("NOTIFY=NEVER combined with other keywords")
 	}
+	return notify, nil
 }
 
-// Wrapper function for writing a complete line to the socket.
-func (s *session) writef(format string, args ...interface{}) error {
-	if s.srv.Timeout > 0 {
-		s.conn.SetWriteDeadline(time.Now().Add(s.srv.Timeout))
+// Parse the value of a RCPT ORCPT parameter (RFC 3461 section 4.2).
+// The address type is an atom, and the address is xtext encoded.
+func parseORcptParam(value string) (string, error) {
+	idx := strings.Index(value, ";")
+	if idx < 1 || idx == len(value)-1 {
+		return "", errors.New("invalid ORCPT parameter")
+	}
+	addrType := value[:idx]
+	for _, c := range addrType {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return "", errors.New("invalid ORCPT address type")
+		}
+	}
+	addr, err := decodeXtext(value[idx+1:])
+	if err != nil {
+		return "", err
 	}
+	return addrType + ";" + addr, nil
+}
 
-	line := fmt.Sprintf(format, args...)
-	fmt.Fprintf(s.bw, line+"\r\n")
-	err := s.bw.Flush()
+// Return the domain of an address, or an empty string if it has none.
+func addressDomain(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return addr[i+1:]
+	}
+	return ""
+}
 
-	if Debug {
-		verb := "WROTE"
-		if s.srv.LogWrite != nil {
-			s.srv.LogWrite(s.remoteIP, verb, line)
-		} else {
-			log.Println(s.remoteIP, verb, line)
+// Report whether domains contains domain, ignoring case.
+func containsDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		if domain != "" && strings.EqualFold(d, domain) {
+			return true
 		}
 	}
-
-	return err
+	return false
 }
 
-// Read a complete line from the socket.
-func (s *session) readLine() (string, error) {
-	if s.srv.Timeout > 0 {
-		s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+// Report whether addrs contains addr. The local part is case-sensitive (RFC 5321 section 2.4) but the domain is not.
+func containsAddress(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		i, j := strings.LastIndex(a, "@"), strings.LastIndex(addr, "@")
+		if i < 0 || j < 0 {
+			if a == addr {
+				return true
+			}
+			continue
+		}
+		if a[:i] == addr[:j] && strings.EqualFold(a[i:], addr[j:]) {
+			return true
+		}
 	}
+	return false
+}
+
+// errEndOfData is returned by readDataLine at the end of the message data.
+var errEndOfData = errors.New("end of data")
+
+// errTooManyBytes is returned by readDataLine once the client has sent more than MaxBytesPerConnection.
+var errTooManyBytes = errors.New("connection byte limit exceeded")
+
+// Report whether the client has sent more than MaxBytesPerConnection. Data read ahead but not yet used is not counted.
+func (s *session) tooManyBytes() bool {
+	return s.srv.MaxBytesPerConnection > 0 && s.bytesIn-int64(s.br.Buffered()) > s.srv.MaxBytesPerConnection
+}
+
+// Read a line of the message data following a DATA command.
+func (s *session) readDataLine() ([]byte, error) {
+	s.setReadDeadline()
 
-	line, err := s.br.ReadString('\n')
+	line, err := readLimitedLine(s.br, s.maxDataLineLength())
+	if err == errLineTooLong {
+		s.afterBareLF = false
+		return nil, lineTooLong(s.maxDataLineLength())
+	}
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if s.srv.Trace != nil {
+		s.srv.Trace(s.id, DirectionIn, strings.TrimRight(string(line), "\r\n"))
+	}
+	if s.tooManyBytes() {
+		return nil, errTooManyBytes
+	}
+	// Handle end of data denoted by lone period (\r\n.\r\n). Servers which accept other sequences, e.g. \n.\r\n,
+	// can be made to take the data as two messages when another server takes it as one (SMTP smuggling), so a lone
+	// period after a bare LF is message data.
+	afterBareLF := s.afterBareLF
+	s.afterBareLF = !bytes.HasSuffix(line, []byte("\r\n"))
+	if bytes.Equal(line, []byte(".\r\n")) && !afterBareLF {
+		return nil, errEndOfData
+	}
+	// Remove leading period (RFC 5321 section 4.5.2)
+	if line[0] == '.' {
+		line = line[1:]
 	}
-	line = strings.TrimSpace(line) // Strip trailing \r\n
+	return line, nil
+}
 
-	if Debug {
-		verb := "READ"
-		if s.srv.LogRead != nil {
-			s.srv.LogRead(s.remoteIP, verb, line)
+// DotStuff prepares a received message for sending to another SMTP server as the data of a DATA command.
+// Handlers receive messages with the leading period removed from lines which started with one (RFC 5321 section
+// 4.5.2), so sending them as is corrupts those lines. DotStuff adds the period back, converts bare LF line endings to
+// CRLF, and ensures the data ends with CRLF. The terminating ".\r\n" is not added.
+// Writers which already dot-stuff, such as the one returned by net/smtp's Client.Data, must not be given its output.
+func DotStuff(data []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.Grow(len(data) + len(data)/64)
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		if len(line) > 0 && line[0] == '.' {
+			buffer.WriteByte('.')
+		}
+		buffer.Write(bytes.TrimSuffix(line, []byte("\r")))
+		buffer.WriteString("\r\n")
+	}
+	return buffer.Bytes()
+}
+
+// DotUnstuff reverses DotStuff, removing the leading period from each line which starts with one, as the server does
+// for received messages. The data must not include the terminating ".\r\n".
+func DotUnstuff(data []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.Grow(len(data))
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i+1], data[i+1:]
 		} else {
-			log.Println(s.remoteIP, verb, line)
+			data = nil
+		}
+		if line[0] == '.' {
+			line = line[1:]
 		}
+		buffer.Write(line)
 	}
+	return buffer.Bytes()
+}
 
-	return line, err
+// Interrupt a blocked read when the context is cancelled, by expiring the read deadline.
+// Returns a function which stops watching the context.
+func (s *session) interruptReads(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
 }
 
-// Parse a line read from the socket.
-func (s *session) parseLine(line string) (verb string, args string) {
-	if idx := strings.Index(line, " "); idx != -1 {
-		verb = strings.ToUpper(line[:idx])
-		args = strings.TrimSpace(line[idx+1:])
-	} else {
-		verb = strings.ToUpper(line)
-		args = ""
+// Read the message data into memory, or a temporary file if it is larger than SpillToDiskThreshold, and pass it to
+// the SpillHandler. Returns the error from reading the data, or from the handler.
+func (s *session) handleSpilled(r *dataReader) error {
+	threshold := s.srv.SpillToDiskThreshold
+	if threshold <= 0 {
+		threshold = defaultSpillThreshold
 	}
-	return verb, args
+	spill := &spillBuffer{threshold: threshold}
+	defer func() {
+		if err := spill.close(); err != nil {
+			s.logf("Failed to remove temporary file: %v", err)
+		}
+	}()
+
+	_, err := spill.Write(s.headers())
+	if err == nil {
+		_, err = io.Copy(spill, r)
+	}
+	if err != nil && err == r.err {
+		return err
+	}
+	var body io.ReadSeeker
+	if err == nil {
+		body, err = spill.reader()
+	}
+	if err != nil {
+		s.logf("Failed to store message data: %v", err)
+		return s.localError()
+	}
+	return s.srv.SpillHandler(s.metadata(), s.from, s.to, body)
 }
 
-// Read the message data following a DATA command.
-func (s *session) readData() ([]byte, error) {
-	var data []byte
+// dataReader streams the message data following a DATA command to a ReaderHandler.
+type dataReader struct {
+	s     *session
+	line  []byte // Unread remainder of the current line
+	size  int    // Bytes of message data read so far
+	lines int    // Lines of message data read so far
+	done  bool   // The end of the data has been reached, or the connection failed
+	err   error  // Error returned once the current line has been read
+}
+
+// Read message data with dot stuffing removed, enforcing the maximum message size.
+func (r *dataReader) Read(p []byte) (int, error) {
+	for len(r.line) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		line, err := r.s.readDataLine()
+		switch {
+		case err == errEndOfData:
+			r.done = true
+			r.err = io.EOF
+		case err == io.EOF:
+			r.done = true
+			r.err = io.ErrUnexpectedEOF
+		case isLineTooLong(err):
+			r.err = err
+		case err != nil:
+			r.done = true
+			r.err = err
+		default:
+			r.size += len(line)
+			r.lines++
+			if maxSize := r.s.maxSize(); maxSize > 0 && r.size > maxSize {
+				r.err = maxSizeExceeded(maxSize)
+			} else if r.s.srv.MaxDataLines > 0 && r.lines > r.s.srv.MaxDataLines {
+				r.err = maxLinesExceeded(r.s.srv.MaxDataLines)
+			} else if r.s.requires7Bit() && has8Bit(line) {
+				r.err = eightBitDataError{}
+			} else if r.s.srv.StrictDataTermination && hasBareLineEnding(line) {
+				r.err = bareLineEndingError{}
+			} else {
+				r.line = line
+			}
+		}
+	}
+	n := copy(p, r.line)
+	r.line = r.line[n:]
+	return n, nil
+}
+
+// Discard any message data not read by the handler, so the next command can be read.
+// Returns an error if the connection failed.
+func (r *dataReader) drain() error {
+	if r.done {
+		if r.err == io.EOF {
+			return nil
+		}
+		return r.err
+	}
 	for {
-		if s.srv.Timeout > 0 {
-			s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+		line, err := r.s.readDataLine()
+		r.size += len(line)
+		if err == errEndOfData {
+			r.done = true
+			return nil
+		}
+		if err != nil && !isLineTooLong(err) {
+			r.done = true
+			return err
 		}
+	}
+}
 
-		line, err := s.br.ReadBytes('\n')
-		if err != nil {
+// Read the message data following a DATA command.
+// Returns ctx.Err() if the context is cancelled before all the data has been read.
+func (s *session) readData(ctx context.Context) ([]byte, error) {
+	defer s.interruptReads(ctx)()
+
+	var data bytes.Buffer
+	var limitErr error // Set when a limit is exceeded or the header is rejected
+	size, lines := 0, 0
+	checkHeader := s.srv.HeaderChecker != nil || len(s.srv.RequireHeaders) > 0
+	enforce7Bit := s.requires7Bit()
+	for {
+		if err := ctx.Err(); err != nil {
 			return nil, err
 		}
-		// Handle end of data denoted by lone period (\r\n.\r\n)
-		if bytes.Equal(line, []byte(".\r\n")) {
+		line, err := s.readDataLine()
+		if err == errEndOfData {
 			break
 		}
-		// Remove leading period (RFC 5321 section 4.5.2)
-		if line[0] == '.' {
-			line = line[1:]
+		if isLineTooLong(err) {
+			// The rest of the line has been discarded, so continue to the end of the data.
+			if limitErr == nil {
+				limitErr = err
+			}
+			data.Reset()
+			continue
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, err
+		}
+
+		// Once a limit is exceeded, discard the rest of the data up to the terminating period,
+		// so any commands pipelined after it are still read correctly.
+		size += len(line)
+		lines++
+		if limitErr != nil {
+			continue
 		}
 
 		// Enforce the maximum message size limit.
-		if s.srv.MaxSize > 0 {
-			if len(data)+len(line) > s.srv.MaxSize {
-				_, _ = s.br.Discard(s.br.Buffered()) // Discard the buffer remnants.
-				return nil, maxSizeExceeded(s.srv.MaxSize)
+		if maxSize := s.maxSize(); maxSize > 0 && size > maxSize {
+			limitErr = maxSizeExceeded(maxSize)
+			data.Reset()
+			continue
+		}
+
+		// Enforce the maximum line count limit.
+		if s.srv.MaxDataLines > 0 && lines > s.srv.MaxDataLines {
+			limitErr = maxLinesExceeded(s.srv.MaxDataLines)
+			data.Reset()
+			continue
+		}
+
+		// Reject 8-bit data if the client did not declare it.
+		if enforce7Bit && has8Bit(line) {
+			limitErr = eightBitDataError{}
+			data.Reset()
+			continue
+		}
+
+		// Reject bare CR and LF, which other servers may handle differently.
+		if s.srv.StrictDataTermination && hasBareLineEnding(line) {
+			limitErr = bareLineEndingError{}
+			data.Reset()
+			continue
+		}
+
+		data.Write(line)
+
+		// Check the header as soon as the blank line ending it is read.
+		if checkHeader && len(bytes.TrimRight(line, "\r\n")) == 0 {
+			checkHeader = false
+			if err := s.checkHeader(data.Bytes()); err != nil {
+				limitErr = err
+				data.Reset()
 			}
 		}
+	}
+	// A message without a body has no blank line after the header.
+	if checkHeader && limitErr == nil {
+		limitErr = s.checkHeader(data.Bytes())
+	}
+	if limitErr != nil {
+		return nil, limitErr
+	}
+	return data.Bytes(), nil
+}
+
+// headerRejectedError wraps an error returned by a HeaderChecker, or the error for a header missing from RequireHeaders.
+type headerRejectedError struct {
+	err error
+}
+
+func (err headerRejectedError) Error() string {
+	return err.err.Error()
+}
+
+// Parse the header of a message, check it has the RequireHeaders and pass it to the HeaderChecker.
+func (s *session) checkHeader(data []byte) error {
+	// A malformed header is passed on as far as it could be parsed.
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	for _, name := range s.srv.RequireHeaders {
+		if _, ok := header[textproto.CanonicalMIMEHeaderKey(name)]; !ok {
+			return headerRejectedError{&Error{Code: 550, EnhancedCode: "5.6.0", Message: formatReply(s.replies().MissingHeader)}}
+		}
+	}
+	if s.srv.HeaderChecker == nil {
+		return nil
+	}
+	if err := s.srv.HeaderChecker(s.metadata(), header); err != nil {
+		return headerRejectedError{err}
+	}
+	return nil
+}
+
+// Report whether a line of message data has a CR or LF other than in the CRLF ending it.
+func hasBareLineEnding(line []byte) bool {
+	return bytes.ContainsAny(bytes.TrimSuffix(line, []byte("\r\n")), "\r\n")
+}
+
+// Report whether an error is due to a line of message data exceeding the maximum length.
+func isLineTooLong(err error) bool {
+	_, ok := err.(lineTooLongError)
+	return ok
+}
+
+// Run the AfterData handler in a new goroutine, once the reply to the message has been sent.
+func (s *session) afterData(err error) {
+	if s.srv.AfterData == nil {
+		return
+	}
+	data := append([]byte(nil), s.buffer.Bytes()...) // The buffer is reused for the next message.
+	go s.srv.AfterData(s.metadata(), s.from, s.to, data, err)
+}
 
-		data = append(data, line...)
+// Create the headers prepended to the message, using the HeaderBuilder if one is configured.
+func (s *session) headers() []byte {
+	if s.srv.HeaderBuilder != nil {
+		return s.srv.HeaderBuilder(s.metadata(), s.to)
 	}
-	return data, nil
+	return s.makeHeaders(s.toSent)
 }
 
-// Create the Received header to comply with RFC 2821 section 3.8.2.
-// TODO: Work out what to do with multiple to addresses.
+// Create the Received header to comply with RFC 2821 section 3.8.2, preceded by the envelope headers if
+// AddEnvelopeHeaders is set. The for clause is only included for a single recipient, as RFC 5321 section 7.6
+// recommends, so the other recipients, e.g. those sent a blind copy, are not revealed to each other.
+// In LMTP mode there is no Received header, as the MTA which passed the message on has added one.
 func (s *session) makeHeaders(to []string) []byte {
 	var buffer bytes.Buffer
-	now := time.Now().Format("Mon, _2 Jan 2006 15:04:05 -0700 (MST)")
-	buffer.WriteString(fmt.Sprintf("Received: from %s (%s [%s])\r\n", s.remoteName, s.remoteHost, s.remoteIP))
-	buffer.WriteString(fmt.Sprintf("        by %s (%s) with SMTP\r\n", s.srv.Hostname, s.srv.Appname))
-	buffer.WriteString(fmt.Sprintf("        for <%s>; %s\r\n", to[0], now))
+	now := s.srv.currentTime().Format("Mon, _2 Jan 2006 15:04:05 -0700 (MST)")
+	if s.srv.AddEnvelopeHeaders {
+		buffer.WriteString(fmt.Sprintf("X-Envelope-From: <%s>\r\n", s.from))
+		for _, rcpt := range s.to {
+			buffer.WriteString(fmt.Sprintf("X-Envelope-To: <%s>\r\n", rcpt))
+		}
+	}
+	if s.srv.ReceivedHeaderMode == ReceivedNone || s.srv.LMTP {
+		return buffer.Bytes()
+	}
+	hideClientIP := s.srv.HideClientIP || s.srv.ReceivedHeaderMode == ReceivedMinimal
+
+	by := fmt.Sprintf("by %s (%s) with SMTP", s.hostname(), s.srv.Appname)
+	if s.srv.HideSoftwareVersion {
+		by = fmt.Sprintf("by %s with SMTP", s.hostname())
+	}
+	switch {
+	case !hideClientIP && s.remoteIP == "unknown":
+		buffer.WriteString(fmt.Sprintf("Received: from %s (unknown)\r\n", s.remoteName))
+	case !hideClientIP:
+		buffer.WriteString(fmt.Sprintf("Received: from %s (%s [%s])\r\n", s.remoteName, s.remoteHost, addressLiteral(s.remoteIP)))
+	case s.authenticated:
+		// The from clause is omitted entirely for authenticated submissions.
+		buffer.WriteString("Received: " + by + "\r\n")
+		by = ""
+	case strings.HasPrefix(s.remoteName, "["):
+		// An address literal would reveal the client IP address.
+		buffer.WriteString("Received: from unknown\r\n")
+	default:
+		buffer.WriteString(fmt.Sprintf("Received: from %s\r\n", s.remoteName))
+	}
+	if s.tlsState != nil {
+		cipher := tls.CipherSuiteName(s.tlsState.CipherSuite)
+		buffer.WriteString(fmt.Sprintf("        (version=%s cipher=%s bits=%d)\r\n",
+			tlsVersionName(s.tlsState.Version), cipher, cipherBits(cipher)))
+	}
+	if by != "" {
+		buffer.WriteString("        " + by + "\r\n")
+	}
+	if len(to) == 1 {
+		buffer.WriteString(fmt.Sprintf("        for <%s>; %s\r\n", to[0], now))
+	} else {
+		buffer.WriteString(fmt.Sprintf("        ; %s\r\n", now))
+	}
+	return buffer.Bytes()
+}
+
+// Return the name of a TLS version as used in Received headers.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// Return the symmetric key size of a cipher suite, from its name.
+func cipherBits(name string) int {
+	switch {
+	case strings.Contains(name, "AES_256"), strings.Contains(name, "CHACHA20"):
+		return 256
+	case strings.Contains(name, "AES_128"), strings.Contains(name, "RC4_128"):
+		return 128
+	case strings.Contains(name, "3DES"):
+		return 168
+	}
+	return 0
+}
+
+// Create the Date and Message-ID headers if they are missing from a submitted message (RFC 6409 section 8).
+func (s *session) makeSubmissionHeaders(data []byte) []byte {
+	var buffer bytes.Buffer
+	if !hasHeader(data, "Date") {
+		buffer.WriteString(fmt.Sprintf("Date: %s\r\n", s.srv.currentTime().Format(time.RFC1123Z)))
+	}
+	if !hasHeader(data, "Message-ID") {
+		id := make([]byte, 16)
+		rand.Read(id)
+		buffer.WriteString(fmt.Sprintf("Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), s.hostname()))
+	}
 	return buffer.Bytes()
 }
 
+// Report whether the header section of a message contains a header field, ignoring case.
+func hasHeader(data []byte, name string) bool {
+	prefix := strings.ToLower(name) + ":"
+	for _, line := range strings.Split(string(data), "\r\n") {
+		if line == "" {
+			break // End of the header section.
+		}
+		if strings.HasPrefix(strings.ToLower(line), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // Determine allowed authentication mechanisms.
 // RFC 4954 specifies that plaintext authentication mechanisms such as LOGIN and PLAIN require a TLS connection.
+// EXTERNAL is only allowed once the client has presented a verified TLS certificate.
 // This can be explicitly overridden e.g. setting s.srv.AuthMechs["LOGIN"] = true.
 func (s *session) authMechs() (mechs map[string]bool) {
 	mechs = map[string]bool{"LOGIN": s.tls, "PLAIN": s.tls, "CRAM-MD5": true}
+	if s.certIdentity() != "" {
+		mechs["EXTERNAL"] = true
+	}
 
 	for mech := range mechs {
 		allowed, found := s.srv.AuthMechs[mech]
@@ -815,33 +3719,81 @@ func (s *session) authMechs() (mechs map[string]bool) {
 	return
 }
 
+// Determine the authentication mechanisms the client can use, which without an AuthHandler is only EXTERNAL.
+func (s *session) usableAuthMechs() map[string]bool {
+	mechs := s.authMechs()
+	if s.srv.AuthHandler == nil {
+		return map[string]bool{"EXTERNAL": mechs["EXTERNAL"]}
+	}
+	return mechs
+}
+
 // Create the greeting string sent in response to an EHLO command.
-func (s *session) makeEHLOResponse() (response string) {
-	response = fmt.Sprintf("250-%s greets %s\r\n", s.srv.Hostname, s.remoteName)
+func (s *session) makeEHLOResponse() string {
+	lines := []string{formatReply(s.replies().Greeting, s.greetingHostname(), s.remoteName)}
 
 	// RFC 1870 specifies that "SIZE 0" indicates no maximum size is in force.
-	response += fmt.Sprintf("250-SIZE %d\r\n", s.srv.MaxSize)
+	if !s.srv.DisableSizeAdvertisement {
+		size := s.maxSize()
+		if s.srv.SizeAdvertiser != nil {
+			size = s.srv.SizeAdvertiser(s.metadata())
+		}
+		lines = append(lines, fmt.Sprintf("SIZE %d", size))
+	}
+
+	// RFC 3461 delivery status notification parameters are always accepted.
+	lines = append(lines, "DSN")
+
+	// Only list 8BITMIME (RFC 6152) if Enforce7Bit is set, as clients only send BODY=8BITMIME if it is listed.
+	if s.srv.Enforce7Bit {
+		lines = append(lines, "8BITMIME")
+	}
 
 	// Only list STARTTLS if TLS is configured, but not currently in use.
-	if s.srv.TLSConfig != nil && !s.tls {
-		response += "250-STARTTLS\r\n"
+	if s.srv.tlsConfig() != nil && !s.tls && !s.commandDisabled("STARTTLS") {
+		lines = append(lines, "STARTTLS")
 	}
 
-	// Only list AUTH if an AuthHandler is configured and at least one mechanism is allowed.
-	if s.srv.AuthHandler != nil {
+	// Only list AUTH if an AuthHandler is configured or EXTERNAL is available, and at least one mechanism is allowed.
+	if (s.srv.AuthHandler != nil || s.certIdentity() != "") && !s.commandDisabled("AUTH") {
 		var mechs []string
-		for mech, allowed := range s.authMechs() {
+		for mech, allowed := range s.usableAuthMechs() {
 			if allowed {
 				mechs = append(mechs, mech)
 			}
 		}
 		if len(mechs) > 0 {
-			response += "250-AUTH " + strings.Join(mechs, " ") + "\r\n"
+			lines = append(lines, "AUTH "+strings.Join(mechs, " "))
 		}
 	}
 
-	response += "250 ENHANCEDSTATUSCODES"
-	return
+	// Only list ATRN if a HandlerAtrn is configured and the client is authenticated.
+	if s.srv.HandlerAtrn != nil && s.authenticated && !s.commandDisabled("ATRN") {
+		lines = append(lines, "ATRN")
+	}
+
+	// Only list ETRN if a HandlerEtrn is configured.
+	if s.srv.HandlerEtrn != nil && !s.commandDisabled("ETRN") {
+		lines = append(lines, "ETRN")
+	}
+
+	if !s.srv.DisableEnhancedStatusCodes {
+		lines = append(lines, "ENHANCEDSTATUSCODES")
+	}
+	return formatMultiline("250", lines)
+}
+
+// Read the client's response to a 334 challenge during AUTH.
+// RFC 4954 section 4 allows the client to abort the exchange by responding with "*".
+func (s *session) readAuthResponse() (string, error) {
+	line, err := s.readLine()
+	if err != nil {
+		return "", err
+	}
+	if line == "*" {
+		return "", errors.New("501 5.7.0 Authentication aborted")
+	}
+	return line, nil
 }
 
 func (s *session) handleAuthLogin(arg string) (bool, error) {
@@ -849,7 +3801,7 @@ func (s *session) handleAuthLogin(arg string) (bool, error) {
 
 	if arg == "" {
 		s.writef("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
-		arg, err = s.readLine()
+		arg, err = s.readAuthResponse()
 		if err != nil {
 			return false, err
 		}
@@ -861,7 +3813,7 @@ func (s *session) handleAuthLogin(arg string) (bool, error) {
 	}
 
 	s.writef("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
-	line, err := s.readLine()
+	line, err := s.readAuthResponse()
 	if err != nil {
 		return false, err
 	}
@@ -873,6 +3825,9 @@ func (s *session) handleAuthLogin(arg string) (bool, error) {
 
 	// Validate credentials.
 	authenticated, err := s.srv.AuthHandler(s.conn.RemoteAddr(), "LOGIN", username, password, nil)
+	if authenticated {
+		s.authUsername = string(username)
+	}
 
 	return authenticated, err
 }
@@ -883,7 +3838,7 @@ func (s *session) handleAuthPlain(arg string) (bool, error) {
 	// If fast mode (AUTH PLAIN [arg]) is not used, prompt for credentials.
 	if arg == "" {
 		s.writef("334 ")
-		arg, err = s.readLine()
+		arg, err = s.readAuthResponse()
 		if err != nil {
 			return false, err
 		}
@@ -901,24 +3856,72 @@ func (s *session) handleAuthPlain(arg string) (bool, error) {
 
 	// Validate credentials.
 	authenticated, err := s.srv.AuthHandler(s.conn.RemoteAddr(), "PLAIN", parts[1], parts[2], nil)
+	if authenticated {
+		s.authUsername = string(parts[1])
+	}
 
 	return authenticated, err
 }
 
+// Authenticate the client as the identity in its verified TLS client certificate (RFC 4422 appendix A), without
+// calling the AuthHandler. The client may send an authorization identity, which must be that identity, or "=" for
+// none, to use it.
+func (s *session) handleAuthExternal(arg string) (bool, error) {
+	var err error
+
+	if arg == "" {
+		s.writef("334 ")
+		arg, err = s.readAuthResponse()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	var authzid string
+	if arg != "=" && arg != "" {
+		data, err := base64.StdEncoding.DecodeString(arg)
+		if err != nil {
+			return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
+		}
+		authzid = string(data)
+	}
+
+	identity := s.certIdentity()
+	if identity == "" || (authzid != "" && authzid != identity) {
+		return false, nil
+	}
+	s.authUsername = identity
+	return true, nil
+}
+
+// Return the identity in the client's verified TLS certificate: its common name, or failing that its first email
+// address or DNS name. Returns an empty string if the client has not presented a verified certificate.
+func (s *session) certIdentity() string {
+	if s.tlsState == nil || len(s.tlsState.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := s.tlsState.PeerCertificates[0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
 func (s *session) handleAuthCramMD5() (bool, error) {
-	shared := "<" + strconv.Itoa(os.Getpid()) + "." + strconv.Itoa(time.Now().Nanosecond()) + "@" + s.srv.Hostname + ">"
+	shared := "<" + strconv.Itoa(os.Getpid()) + "." + strconv.Itoa(s.srv.currentTime().Nanosecond()) + "@" + s.hostname() + ">"
 
 	s.writef("334 " + base64.StdEncoding.EncodeToString([]byte(shared)))
 
-	data, err := s.readLine()
+	data, err := s.readAuthResponse()
 	if err != nil {
 		return false, err
 	}
 
-	if data == "*" {
-		return false, errors.New("501 5.7.0 Authentication cancelled")
-	}
-
 	buf, err := base64.StdEncoding.DecodeString(data)
 	if err != nil {
 		return false, errors.New("501 5.5.2 Syntax error (unable to decode)")
@@ -931,6 +3934,9 @@ func (s *session) handleAuthCramMD5() (bool, error) {
 
 	// Validate credentials.
 	authenticated, err := s.srv.AuthHandler(s.conn.RemoteAddr(), "CRAM-MD5", []byte(fields[0]), []byte(fields[1]), []byte(shared))
+	if authenticated {
+		s.authUsername = fields[0]
+	}
 
 	return authenticated, err
 }
@@ -0,0 +1,58 @@
+package smtpd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Default for SpillToDiskThreshold.
+const defaultSpillThreshold = 1 << 20
+
+// spillBuffer holds message data in memory until it exceeds a threshold, then moves it to a temporary file which
+// receives the rest, so large messages do not use more memory than the threshold.
+type spillBuffer struct {
+	threshold int
+	buf       bytes.Buffer
+	file      *os.File // Temporary file, once the threshold has been exceeded
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.buf.Len()+len(p) > b.threshold {
+		f, err := ioutil.TempFile("", "smtpd-")
+		if err != nil {
+			return 0, err
+		}
+		b.file = f
+		if _, err := b.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	if b.file != nil {
+		return b.file.Write(p)
+	}
+	return b.buf.Write(p)
+}
+
+// Return a reader for the data written, positioned at the start.
+func (b *spillBuffer) reader() (io.ReadSeeker, error) {
+	if b.file == nil {
+		return bytes.NewReader(b.buf.Bytes()), nil
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return b.file, nil
+}
+
+// Remove the temporary file, if one was created.
+func (b *spillBuffer) close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	err := os.Remove(b.file.Name())
+	b.file = nil
+	return err
+}
@@ -0,0 +1,51 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpillBuffer(t *testing.T) {
+	b := &spillBuffer{threshold: 10}
+	b.Write([]byte("12345"))
+	b.Write([]byte("67890"))
+	if b.file != nil {
+		t.Errorf("Data of the threshold size was written to a file")
+	}
+
+	// Once the threshold is exceeded, the data held in memory moves to the file.
+	b.Write([]byte("abc"))
+	if b.file == nil {
+		t.Fatalf("Data above the threshold was not written to a file")
+	}
+	name := b.file.Name()
+	r, err := b.reader()
+	if err != nil {
+		t.Fatalf("reader() returned error %v", err)
+	}
+	if data, _ := ioutil.ReadAll(r); string(data) != "1234567890abc" {
+		t.Errorf("reader() returned %q, want %q", data, "1234567890abc")
+	}
+
+	if err := b.close(); err != nil {
+		t.Errorf("close() returned error %v", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Temporary file %s was not removed", name)
+	}
+	if err := b.close(); err != nil {
+		t.Errorf("Second close() returned error %v", err)
+	}
+
+	// Small data stays in memory.
+	b = &spillBuffer{threshold: 10}
+	b.Write([]byte("small"))
+	r, _ = b.reader()
+	if _, ok := r.(*os.File); ok || b.close() != nil {
+		t.Errorf("Data below the threshold was written to a file")
+	}
+	if data, _ := ioutil.ReadAll(r); string(data) != "small" {
+		t.Errorf("reader() returned %q, want %q", data, "small")
+	}
+}
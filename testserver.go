@@ -0,0 +1,40 @@
+package smtpd
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// NewTestServer starts an in-memory session of srv for tests, e.g. of handlers in packages built on smtpd, without
+// listening on a network port. It reads the banner, failing the test unless it is a 220 reply, and returns the client
+// end of the connection. The cleanup function closes the connection and waits for the session to end.
+// The session has no remote IP address, so "unknown" is used in its place, e.g. in the Received header.
+func NewTestServer(t testing.TB, srv *Server) (clientConn net.Conn, cleanup func()) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	session := srv.newSession(serverConn)
+	atomic.AddInt32(&srv.openSessions, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		session.serve()
+	}()
+	cleanup = func() {
+		clientConn.Close()
+		<-done
+	}
+
+	banner, err := bufio.NewReader(clientConn).ReadString('\n')
+	if err != nil {
+		cleanup()
+		t.Fatalf("Failed to read banner from test server: %v", err)
+	}
+	if !strings.HasPrefix(banner, "220") {
+		cleanup()
+		t.Fatalf("Read incorrect banner from test server: %v", banner)
+	}
+	return clientConn, cleanup
+}
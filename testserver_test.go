@@ -0,0 +1,41 @@
+package smtpd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNewTestServer(t *testing.T) {
+	received := make(chan string, 1)
+	handler := func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+		received <- fmt.Sprintf("%s %v %s", from, to, data[strings.Index(string(data), "Subject: "):])
+		return nil
+	}
+	conn, cleanup := NewTestServer(t, &Server{Handler: handler, DisableReverseDNS: true})
+	defer cleanup()
+
+	reader := bufio.NewReader(conn)
+	for _, cmd := range []struct{ line, code string }{
+		{"HELO host.example.com", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"RCPT TO:<recipient@example.com>", "250"},
+		{"DATA", "354"},
+		{"Subject: Test\r\n\r\nTest message.\r\n.", "250"},
+		{"QUIT", "221"},
+	} {
+		fmt.Fprintf(conn, "%s\r\n", cmd.line)
+		resp, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read response to %q: %v", cmd.line, err)
+		}
+		if !strings.HasPrefix(resp, cmd.code) {
+			t.Errorf("Response to %q is %q, want %s", cmd.line, resp, cmd.code)
+		}
+	}
+	if msg, want := <-received, "sender@example.com [recipient@example.com] Subject: Test\r\n\r\nTest message.\r\n"; msg != want {
+		t.Errorf("Handler received %q, want %q", msg, want)
+	}
+}